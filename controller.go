@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lrascao/dnsproxy/grpcapi"
+	"github.com/lrascao/dnsproxy/policy"
+)
+
+// controller owns the runner's destination set and the channel Run()
+// consumes destination updates from, so the REST admin endpoint and the
+// gRPC Admin service can share exactly one code path for reading and
+// mutating destinations instead of duplicating it. It also tracks the
+// per-destination QPS and health-status transitions that back the gRPC
+// WatchStatus stream, which the REST endpoint has no equivalent for.
+type controller struct {
+	destinations *destinationSet
+	updateCh     chan<- []destination
+
+	mu       sync.Mutex
+	watchers map[chan grpcapi.StatusEvent]struct{}
+
+	qpsMu     sync.Mutex
+	qpsCounts map[string]int64
+	qpsSince  time.Time
+}
+
+func newController(destinations *destinationSet, updateCh chan<- []destination) *controller {
+	return &controller{
+		destinations: destinations,
+		updateCh:     updateCh,
+		watchers:     make(map[chan grpcapi.StatusEvent]struct{}),
+		qpsCounts:    make(map[string]int64),
+		qpsSince:     time.Now(),
+	}
+}
+
+// List returns every configured destination.
+func (c *controller) List() []destination {
+	return c.destinations.All()
+}
+
+// Set replaces the whole destination set. Any destination arriving without
+// a latency EWMA (e.g. JSON-decoded from the REST admin endpoint, whose
+// unexported latency field json.Unmarshal can never populate) gets a fresh
+// one, the same way Add does.
+func (c *controller) Set(destinations []destination) {
+	for i, d := range destinations {
+		if d.latency == nil {
+			destinations[i].latency = policy.NewEWMA(0.3)
+		}
+	}
+	c.updateCh <- destinations
+}
+
+// Add appends d to the destination set, failing if its name is already in
+// use.
+func (c *controller) Add(d destination) error {
+	existing := c.destinations.All()
+	for _, e := range existing {
+		if e.Name == d.Name {
+			return fmt.Errorf("destination %q already exists", d.Name)
+		}
+	}
+	if d.latency == nil {
+		d.latency = policy.NewEWMA(0.3)
+	}
+	c.updateCh <- append(existing, d)
+	return nil
+}
+
+// Remove drops the destination named name, failing if it isn't configured.
+func (c *controller) Remove(name string) error {
+	existing := c.destinations.All()
+	out := make([]destination, 0, len(existing))
+	found := false
+	for _, e := range existing {
+		if e.Name == name {
+			found = true
+			continue
+		}
+		out = append(out, e)
+	}
+	if !found {
+		return fmt.Errorf("destination %q not found", name)
+	}
+	c.updateCh <- out
+	return nil
+}
+
+// Subscribe registers a new WatchStatus listener, returning the channel it
+// should read events from and a cancel func to unregister and release it.
+func (c *controller) Subscribe() (<-chan grpcapi.StatusEvent, func()) {
+	ch := make(chan grpcapi.StatusEvent, 16)
+
+	c.mu.Lock()
+	c.watchers[ch] = struct{}{}
+	c.mu.Unlock()
+
+	cancel := func() {
+		c.mu.Lock()
+		delete(c.watchers, ch)
+		c.mu.Unlock()
+	}
+	return ch, cancel
+}
+
+// broadcast fans ev out to every current watcher, dropping it for any
+// watcher whose buffer is full rather than blocking the health check loop.
+func (c *controller) broadcast(ev grpcapi.StatusEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for ch := range c.watchers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// recordQuery counts one forwarded query for name towards the next QPS
+// sample.
+func (c *controller) recordQuery(name string) {
+	c.qpsMu.Lock()
+	c.qpsCounts[name]++
+	c.qpsMu.Unlock()
+}
+
+// sampleQPS drains the per-destination query counts accumulated since the
+// last sample and returns the resulting rate, resetting the window.
+func (c *controller) sampleQPS() map[string]float64 {
+	c.qpsMu.Lock()
+	defer c.qpsMu.Unlock()
+
+	elapsed := time.Since(c.qpsSince).Seconds()
+	c.qpsSince = time.Now()
+	if elapsed <= 0 {
+		return nil
+	}
+
+	out := make(map[string]float64, len(c.qpsCounts))
+	for name, count := range c.qpsCounts {
+		out[name] = float64(count) / elapsed
+		delete(c.qpsCounts, name)
+	}
+	return out
+}
+
+// grpcController adapts controller's internal destination type to the
+// plain structs grpcapi (and its gRPC wire format) uses.
+type grpcController struct {
+	*controller
+}
+
+func (g grpcController) List() []grpcapi.Destination {
+	destinations := g.controller.List()
+	out := make([]grpcapi.Destination, 0, len(destinations))
+	for _, d := range destinations {
+		out = append(out, toGRPCDestination(d))
+	}
+	return out
+}
+
+func (g grpcController) Set(destinations []grpcapi.Destination) {
+	g.controller.Set(fromGRPCDestinations(destinations))
+}
+
+func (g grpcController) Add(d grpcapi.Destination) error {
+	return g.controller.Add(fromGRPCDestination(d))
+}
+
+func toGRPCDestination(d destination) grpcapi.Destination {
+	return grpcapi.Destination{
+		Name:      d.Name,
+		Address:   d.Address,
+		Protocol:  d.Protocol,
+		Bootstrap: d.Bootstrap,
+		Weight:    d.Weight,
+		Priority:  d.Priority,
+	}
+}
+
+func fromGRPCDestination(d grpcapi.Destination) destination {
+	return destination{
+		Name:      d.Name,
+		Address:   d.Address,
+		Protocol:  d.Protocol,
+		Bootstrap: d.Bootstrap,
+		Weight:    d.Weight,
+		Priority:  d.Priority,
+		latency:   policy.NewEWMA(0.3),
+	}
+}
+
+func fromGRPCDestinations(in []grpcapi.Destination) []destination {
+	out := make([]destination, 0, len(in))
+	for _, d := range in {
+		out = append(out, fromGRPCDestination(d))
+	}
+	return out
+}
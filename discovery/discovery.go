@@ -0,0 +1,323 @@
+// Package discovery implements the dynamic destination-discovery sources
+// that can feed the forwarder/server alongside (or instead of) the static
+// forward.static list: periodic DNS SRV resolution and Consul catalog
+// polling. The file-based source lives in main, since reloading it means
+// re-reading the same config struct viper already unmarshals forward.static
+// into. Every source reports a full target list rather than deltas; Coalesce
+// merges the latest list from each source and debounces bursts of change
+// before handing a single combined list to the caller.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Target is the common shape every discovery source produces. It mirrors
+// the fields main's destination type reads from the admin API and static
+// config, so callers can convert 1:1.
+type Target struct {
+	Name      string
+	Address   string
+	Protocol  string
+	Bootstrap string
+	Weight    int
+	Priority  int
+}
+
+// Source watches one discovery mechanism and sends its current full target
+// list on ch every time it changes, until ctx is done.
+type Source interface {
+	Watch(ctx context.Context, ch chan<- []Target)
+}
+
+// SRVSource periodically resolves a DNS SRV record and reports one target
+// per record, named after the record's target host.
+type SRVSource struct {
+	// Name is the SRV record to resolve, e.g. "_dns._udp.resolvers.example.com".
+	Name string
+	// Interval is how often to re-resolve. Defaults to 30s.
+	Interval time.Duration
+	// Resolver is used to look up the SRV record; defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+// Watch implements Source.
+func (s SRVSource) Watch(ctx context.Context, ch chan<- []Target) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	resolve := func() {
+		_, records, err := resolver.LookupSRV(ctx, "", "", s.Name)
+		if err != nil {
+			return
+		}
+
+		targets := make([]Target, 0, len(records))
+		for _, rr := range records {
+			host := rr.Target
+			targets = append(targets, Target{
+				Name:    host,
+				Address: net.JoinHostPort(host, strconv.Itoa(int(rr.Port))),
+				Weight:  int(rr.Weight),
+				// SRV priority is lower-wins (RFC 2782); policy.Destination's
+				// Priority is higher-wins, so invert it here rather than
+				// making every Selector aware of two opposite conventions.
+				Priority: math.MaxUint16 - int(rr.Priority),
+			})
+		}
+		select {
+		case ch <- targets:
+		case <-ctx.Done():
+		}
+	}
+
+	resolve()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			resolve()
+		}
+	}
+}
+
+// ConsulSource watches a Consul service via the catalog API's blocking
+// queries, reporting one target per catalog entry. Entries are not filtered
+// by their Consul health check status.
+type ConsulSource struct {
+	// Address is Consul's HTTP API base address, e.g. "http://127.0.0.1:8500".
+	Address string
+	// Service is the service name to watch.
+	Service string
+	// Datacenter, if set, is passed as Consul's ?dc= query parameter.
+	Datacenter string
+	// Wait bounds each blocking query; defaults to 55s.
+	Wait time.Duration
+
+	Client *http.Client
+}
+
+type consulCatalogEntry struct {
+	ServiceID      string
+	ServiceAddress string
+	ServicePort    int
+	Address        string
+}
+
+// Watch implements Source. It polls Consul's blocking query API
+// indefinitely, only sending an update when the catalog index advances.
+func (s ConsulSource) Watch(ctx context.Context, ch chan<- []Target) {
+	wait := s.Wait
+	if wait <= 0 {
+		wait = 55 * time.Second
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: wait + 10*time.Second}
+	}
+
+	var index string
+	for {
+		entries, newIndex, err := s.query(ctx, client, index, wait)
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+				continue
+			}
+		}
+
+		if newIndex != index {
+			index = newIndex
+
+			targets := make([]Target, 0, len(entries))
+			for _, e := range entries {
+				addr := e.ServiceAddress
+				if addr == "" {
+					addr = e.Address
+				}
+				targets = append(targets, Target{
+					Name:    e.ServiceID,
+					Address: net.JoinHostPort(addr, strconv.Itoa(e.ServicePort)),
+				})
+			}
+			select {
+			case ch <- targets:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (s ConsulSource) query(ctx context.Context, client *http.Client, index string, wait time.Duration) ([]consulCatalogEntry, string, error) {
+	u, err := url.Parse(fmt.Sprintf("%s/v1/catalog/service/%s", s.Address, url.PathEscape(s.Service)))
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing consul address: %w", err)
+	}
+	q := u.Query()
+	if s.Datacenter != "" {
+		q.Set("dc", s.Datacenter)
+	}
+	if index != "" {
+		q.Set("index", index)
+		q.Set("wait", wait.String())
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("building consul request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("querying consul: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("consul returned status %d", resp.StatusCode)
+	}
+
+	var entries []consulCatalogEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, "", fmt.Errorf("decoding consul response: %w", err)
+	}
+
+	return entries, resp.Header.Get("X-Consul-Index"), nil
+}
+
+// Coalesce runs every source and merges their current target lists into
+// one, debouncing bursts of change so a flurry of updates (e.g. several SRV
+// records changing at once) only produces one merged list, quiet seconds
+// after the last change. The returned channel is closed when ctx is done.
+func Coalesce(ctx context.Context, sources []Source, quiet time.Duration) <-chan []Target {
+	type update struct {
+		source  int
+		targets []Target
+	}
+	updates := make(chan update)
+	for i, src := range sources {
+		i, src := i, src
+		go func() {
+			ch := make(chan []Target)
+			go src.Watch(ctx, ch)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case targets, ok := <-ch:
+					if !ok {
+						return
+					}
+					select {
+					case updates <- update{source: i, targets: targets}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	out := make(chan []Target)
+
+	go func() {
+		defer close(out)
+
+		latest := make([][]Target, len(sources))
+		var (
+			pending bool
+			timer   *time.Timer
+			timerCh <-chan time.Time
+		)
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case u := <-updates:
+				latest[u.source] = u.targets
+				pending = true
+				if timer == nil {
+					timer = time.NewTimer(quiet)
+				} else {
+					if !timer.Stop() {
+						select {
+						case <-timer.C:
+						default:
+						}
+					}
+					timer.Reset(quiet)
+				}
+				timerCh = timer.C
+			case <-timerCh:
+				if !pending {
+					continue
+				}
+				pending = false
+
+				select {
+				case out <- merge(latest):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// merge flattens each source's current target list into one sorted,
+// deduplicated-by-name slice, later sources (by index) winning on name
+// collisions.
+func merge(perSource [][]Target) []Target {
+	byName := make(map[string]Target)
+	var order []string
+	for _, targets := range perSource {
+		for _, t := range targets {
+			if _, ok := byName[t.Name]; !ok {
+				order = append(order, t.Name)
+			}
+			byName[t.Name] = t
+		}
+	}
+	sort.Strings(order)
+
+	out := make([]Target, 0, len(order))
+	for _, name := range order {
+		out = append(out, byName[name])
+	}
+	return out
+}
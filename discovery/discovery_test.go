@@ -0,0 +1,99 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMergeSortsAndDedupesByNameLaterSourceWins(t *testing.T) {
+	perSource := [][]Target{
+		{{Name: "b", Address: "1.1.1.1:53"}, {Name: "a", Address: "2.2.2.2:53"}},
+		{{Name: "a", Address: "3.3.3.3:53"}},
+	}
+
+	got := merge(perSource)
+
+	want := []Target{
+		{Name: "a", Address: "3.3.3.3:53"},
+		{Name: "b", Address: "1.1.1.1:53"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("merge() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("merge()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestMergeEmpty(t *testing.T) {
+	if got := merge(nil); len(got) != 0 {
+		t.Fatalf("merge(nil) = %v, want empty", got)
+	}
+}
+
+// fakeSource sends each element of targets on ch, one at a time, whenever
+// send is signalled, until ctx is done.
+type fakeSource struct {
+	targets [][]Target
+	send    chan struct{}
+}
+
+func (f fakeSource) Watch(ctx context.Context, ch chan<- []Target) {
+	for _, targets := range f.targets {
+		select {
+		case <-f.send:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case ch <- targets:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func TestCoalesceDebouncesAndMergesLatestPerSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sendA := make(chan struct{})
+	sendB := make(chan struct{})
+	sources := []Source{
+		fakeSource{targets: [][]Target{{{Name: "a", Address: "1.1.1.1:53"}}}, send: sendA},
+		fakeSource{targets: [][]Target{{{Name: "b", Address: "2.2.2.2:53"}}}, send: sendB},
+	}
+
+	out := Coalesce(ctx, sources, 20*time.Millisecond)
+
+	sendA <- struct{}{}
+	sendB <- struct{}{}
+
+	select {
+	case targets := <-out:
+		if len(targets) != 2 {
+			t.Fatalf("merged targets = %v, want 2 entries", targets)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for coalesced update")
+	}
+}
+
+func TestCoalesceClosesOutputWhenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := Coalesce(ctx, nil, 10*time.Millisecond)
+
+	cancel()
+
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Fatal("expected out to be closed with no sources configured")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for out to close")
+	}
+}
@@ -0,0 +1,172 @@
+// Package grpcapi implements the Admin gRPC service described by
+// admin.proto: destination list/set/add/remove, mirroring the REST admin
+// endpoint, plus a server-streaming WatchStatus RPC with no REST
+// equivalent. The message types below and the service registration
+// machinery in this file are hand-written in the shape protoc-gen-go and
+// protoc-gen-go-grpc would otherwise generate from admin.proto, since this
+// build environment has no protoc available; see codec.go for how that
+// works without real proto.Message types.
+package grpcapi
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// Destination is the wire shape of a forwarding destination.
+type Destination struct {
+	Name      string `json:"name"`
+	Address   string `json:"address"`
+	Protocol  string `json:"protocol,omitempty"`
+	Bootstrap string `json:"bootstrap,omitempty"`
+	Weight    int    `json:"weight,omitempty"`
+	Priority  int    `json:"priority,omitempty"`
+}
+
+type ListDestinationsRequest struct{}
+
+type ListDestinationsResponse struct {
+	Destinations []Destination `json:"destinations"`
+}
+
+type SetDestinationsRequest struct {
+	Destinations []Destination `json:"destinations"`
+}
+
+type SetDestinationsResponse struct{}
+
+type AddDestinationRequest struct {
+	Destination Destination `json:"destination"`
+}
+
+type AddDestinationResponse struct{}
+
+type RemoveDestinationRequest struct {
+	Name string `json:"name"`
+}
+
+type RemoveDestinationResponse struct{}
+
+type WatchStatusRequest struct{}
+
+// StatusEvent is one destination's health status and recent queries-per-
+// second, pushed by WatchStatus whenever the runner's health check runs.
+type StatusEvent struct {
+	Destination string  `json:"destination"`
+	Status      string  `json:"status"`
+	QPS         float64 `json:"qps"`
+}
+
+// AdminServer is the server API for the Admin service.
+type AdminServer interface {
+	ListDestinations(context.Context, *ListDestinationsRequest) (*ListDestinationsResponse, error)
+	SetDestinations(context.Context, *SetDestinationsRequest) (*SetDestinationsResponse, error)
+	AddDestination(context.Context, *AddDestinationRequest) (*AddDestinationResponse, error)
+	RemoveDestination(context.Context, *RemoveDestinationRequest) (*RemoveDestinationResponse, error)
+	WatchStatus(*WatchStatusRequest, Admin_WatchStatusServer) error
+}
+
+// Admin_WatchStatusServer is the server-side stream handle WatchStatus
+// sends StatusEvents on.
+type Admin_WatchStatusServer interface {
+	Send(*StatusEvent) error
+	grpc.ServerStream
+}
+
+type adminWatchStatusServer struct {
+	grpc.ServerStream
+}
+
+func (x *adminWatchStatusServer) Send(m *StatusEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// RegisterAdminServer registers srv with s, the same call a generated
+// _grpc.pb.go would expose.
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&adminServiceDesc, srv)
+}
+
+func _Admin_ListDestinations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDestinationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListDestinations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/dnsproxy.admin.Admin/ListDestinations"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListDestinations(ctx, req.(*ListDestinationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_SetDestinations_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetDestinationsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).SetDestinations(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/dnsproxy.admin.Admin/SetDestinations"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).SetDestinations(ctx, req.(*SetDestinationsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_AddDestination_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddDestinationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).AddDestination(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/dnsproxy.admin.Admin/AddDestination"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).AddDestination(ctx, req.(*AddDestinationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_RemoveDestination_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveDestinationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RemoveDestination(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/dnsproxy.admin.Admin/RemoveDestination"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RemoveDestination(ctx, req.(*RemoveDestinationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_WatchStatus_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchStatusRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AdminServer).WatchStatus(m, &adminWatchStatusServer{stream})
+}
+
+var adminServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dnsproxy.admin.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "ListDestinations", Handler: _Admin_ListDestinations_Handler},
+		{MethodName: "SetDestinations", Handler: _Admin_SetDestinations_Handler},
+		{MethodName: "AddDestination", Handler: _Admin_AddDestination_Handler},
+		{MethodName: "RemoveDestination", Handler: _Admin_RemoveDestination_Handler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "WatchStatus", Handler: _Admin_WatchStatus_Handler, ServerStreams: true},
+	},
+	Metadata: "admin.proto",
+}
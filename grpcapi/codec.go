@@ -0,0 +1,24 @@
+package grpcapi
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// jsonCodec lets the plain structs in this package travel over gRPC without
+// depending on protoc-generated proto.Message implementations: it replaces
+// grpc-go's default "proto" codec with one that marshals whatever value is
+// passed as JSON instead. This is only safe because the Admin service is
+// the only thing using this process's default gRPC codec.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+func (jsonCodec) Name() string { return "proto" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
@@ -0,0 +1,80 @@
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Controller is the surface the Admin service needs from main's runner: the
+// same destination list/set/add/remove operations behind the REST admin
+// endpoint, plus subscribing to status/QPS events for WatchStatus. main's
+// controller type implements this by converting to/from its internal
+// destination representation.
+type Controller interface {
+	List() []Destination
+	Set(destinations []Destination)
+	Add(d Destination) error
+	Remove(name string) error
+	Subscribe() (<-chan StatusEvent, func())
+}
+
+// Server implements AdminServer by delegating to a Controller, which is
+// shared with the REST admin endpoint so both surfaces see and mutate
+// exactly the same destination set.
+type Server struct {
+	Controller Controller
+}
+
+// NewServer returns an AdminServer backed by ctrl.
+func NewServer(ctrl Controller) *Server {
+	return &Server{Controller: ctrl}
+}
+
+func (s *Server) ListDestinations(context.Context, *ListDestinationsRequest) (*ListDestinationsResponse, error) {
+	return &ListDestinationsResponse{Destinations: s.Controller.List()}, nil
+}
+
+func (s *Server) SetDestinations(_ context.Context, req *SetDestinationsRequest) (*SetDestinationsResponse, error) {
+	s.Controller.Set(req.Destinations)
+	return &SetDestinationsResponse{}, nil
+}
+
+func (s *Server) AddDestination(_ context.Context, req *AddDestinationRequest) (*AddDestinationResponse, error) {
+	if req.Destination.Name == "" || req.Destination.Address == "" {
+		return nil, status.Error(codes.InvalidArgument, "destination name and address are required")
+	}
+	if err := s.Controller.Add(req.Destination); err != nil {
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("%v", err))
+	}
+	return &AddDestinationResponse{}, nil
+}
+
+func (s *Server) RemoveDestination(_ context.Context, req *RemoveDestinationRequest) (*RemoveDestinationResponse, error) {
+	if err := s.Controller.Remove(req.Name); err != nil {
+		return nil, status.Error(codes.NotFound, fmt.Sprintf("%v", err))
+	}
+	return &RemoveDestinationResponse{}, nil
+}
+
+func (s *Server) WatchStatus(_ *WatchStatusRequest, stream Admin_WatchStatusServer) error {
+	events, cancel := s.Controller.Subscribe()
+	defer cancel()
+
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(&ev); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Package health implements the per-destination health-check state machine:
+// configurable healthy/unhealthy thresholds, exponential backoff between
+// probes of a failing destination, and a gradual ramp back to full traffic
+// on recovery rather than an immediate flip. It also folds in passive
+// signal from the forwarder's own error rate, for destinations where an
+// active probe alone would miss real failures (or vice versa).
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// Probe identifies how a destination is actively checked.
+type Probe string
+
+const (
+	// ProbeA expects a normal A-record answer (the original behaviour).
+	ProbeA Probe = "dns_a"
+	// ProbeANY expects the server to be reachable and respond, even if
+	// that response is REFUSED, which many resolvers return for ANY
+	// queries while still being perfectly healthy.
+	ProbeANY Probe = "dns_any"
+	// ProbeSOA expects a normal SOA answer.
+	ProbeSOA Probe = "dns_soa"
+)
+
+// Status is a destination's current place in the state machine.
+type Status int
+
+const (
+	// StatusUnknown is the initial state before any probe has completed.
+	StatusUnknown Status = iota
+	// StatusHealthy destinations receive full traffic.
+	StatusHealthy
+	// StatusUnhealthy destinations are out of rotation.
+	StatusUnhealthy
+	// StatusRecovering destinations have passed enough consecutive
+	// probes to no longer be unhealthy, but are still ramping back up
+	// to full traffic rather than being trusted immediately.
+	StatusRecovering
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusHealthy:
+		return "healthy"
+	case StatusUnhealthy:
+		return "unhealthy"
+	case StatusRecovering:
+		return "recovering"
+	default:
+		return "unknown"
+	}
+}
+
+// Config controls the thresholds, timing and probe type shared by every
+// destination in a Set. It corresponds to the healthCheck section of the
+// YAML config.
+type Config struct {
+	// HealthyThreshold is how many consecutive passing probes move a
+	// never-probed destination to healthy, or an unhealthy one to
+	// recovering; a recovering destination then gains 1/HealthyThreshold
+	// of ramp weight per further pass until it is fully healthy.
+	HealthyThreshold int
+	// UnhealthyThreshold is how many consecutive failing probes move a
+	// destination to unhealthy.
+	UnhealthyThreshold int
+	// Timeout bounds a single probe.
+	Timeout time.Duration
+	// Interval is the steady-state time between probes of a healthy
+	// destination.
+	Interval time.Duration
+	// Backoff is added to Interval once per consecutive failure while a
+	// destination is unhealthy, up to MaxBackoff.
+	Backoff time.Duration
+	// MaxBackoff caps the backed-off probe interval.
+	MaxBackoff time.Duration
+	// Probe selects the active probe type.
+	Probe Probe
+	// PassiveErrorThreshold, if non-zero, marks a destination unhealthy
+	// once its forwarding error rate (over PassiveWindow samples) meets
+	// or exceeds it, independent of the active probe.
+	PassiveErrorThreshold float64
+	// PassiveWindow is how many recent forward attempts the passive
+	// error rate is computed over.
+	PassiveWindow int
+}
+
+// withDefaults fills in zero fields with sane defaults so a Config read
+// from a mostly-empty YAML section still behaves sensibly.
+func (c Config) withDefaults() Config {
+	if c.HealthyThreshold <= 0 {
+		c.HealthyThreshold = 2
+	}
+	if c.UnhealthyThreshold <= 0 {
+		c.UnhealthyThreshold = 1
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.Interval <= 0 {
+		c.Interval = 30 * time.Second
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 5 * time.Minute
+	}
+	if c.Probe == "" {
+		c.Probe = ProbeA
+	}
+	if c.PassiveWindow <= 0 {
+		c.PassiveWindow = 20
+	}
+	return c
+}
+
+// entry is the mutable state machine for a single destination.
+type entry struct {
+	status Status
+
+	consecutivePass int
+	consecutiveFail int
+	nextCheck       time.Time
+	backoffStep     int
+
+	// rampWeight is the fraction [0,1] of full weight a recovering
+	// destination should currently receive; it increases by 1/HealthyThreshold
+	// for every consecutive pass until it reaches 1 and the destination
+	// is promoted to StatusHealthy. Any failed probe resets it to 0.
+	rampWeight float64
+
+	// passive forward-error tracking, as a small ring of recent outcomes.
+	passiveOutcomes []bool
+	passiveNext     int
+}
+
+// Set tracks health.entry state for a group of destinations that share one
+// Config, keyed by destination name. It is the "destinationSet" backing
+// store: callers keep their own destination data (address, weight, ...) and
+// use Set purely to decide who is in rotation and at what ramp weight.
+type Set struct {
+	mu      sync.Mutex
+	cfg     Config
+	entries map[string]*entry
+}
+
+// NewSet returns a Set that evaluates every destination against cfg.
+func NewSet(cfg Config) *Set {
+	return &Set{
+		cfg:     cfg.withDefaults(),
+		entries: make(map[string]*entry),
+	}
+}
+
+// Sync ensures exactly one entry exists per name in names, adding new ones
+// in StatusUnknown and dropping ones that are no longer configured.
+func (s *Set) Sync(names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	want := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		want[name] = struct{}{}
+		if _, ok := s.entries[name]; !ok {
+			s.entries[name] = &entry{}
+		}
+	}
+	for name := range s.entries {
+		if _, ok := want[name]; !ok {
+			delete(s.entries, name)
+		}
+	}
+}
+
+// DueActive returns the names due for their next active probe at now.
+func (s *Set) DueActive(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []string
+	for name, e := range s.entries {
+		if now.Before(e.nextCheck) {
+			continue
+		}
+		due = append(due, name)
+	}
+	return due
+}
+
+// RecordActive folds the result of an active probe into name's state
+// machine and schedules its next probe.
+func (s *Set) RecordActive(name string, passed bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[name]
+	if !ok {
+		e = &entry{}
+		s.entries[name] = e
+	}
+
+	if passed {
+		e.consecutiveFail = 0
+		e.consecutivePass++
+		e.backoffStep = 0
+
+		switch e.status {
+		case StatusUnhealthy:
+			if e.consecutivePass >= s.cfg.HealthyThreshold {
+				e.status = StatusRecovering
+				e.rampWeight = 1.0 / float64(s.cfg.HealthyThreshold)
+			}
+		case StatusRecovering:
+			e.rampWeight += 1.0 / float64(s.cfg.HealthyThreshold)
+			if e.rampWeight >= 1.0 {
+				e.rampWeight = 1.0
+				e.status = StatusHealthy
+			}
+		case StatusUnknown:
+			if e.consecutivePass >= s.cfg.HealthyThreshold {
+				e.status = StatusHealthy
+				e.rampWeight = 1.0
+			}
+		case StatusHealthy:
+			e.rampWeight = 1.0
+		}
+
+		e.nextCheck = now.Add(s.cfg.Interval)
+		return
+	}
+
+	e.consecutivePass = 0
+	e.consecutiveFail++
+	e.rampWeight = 0
+
+	if e.consecutiveFail >= s.cfg.UnhealthyThreshold {
+		e.status = StatusUnhealthy
+	}
+
+	e.nextCheck = now.Add(s.backoffFor(e))
+}
+
+// backoffFor returns the delay before the next probe of an unhealthy
+// destination, growing by one Backoff increment per consecutive failure
+// (capped at MaxBackoff), and resets to Interval for anything not
+// unhealthy.
+func (s *Set) backoffFor(e *entry) time.Duration {
+	if e.status != StatusUnhealthy || s.cfg.Backoff <= 0 {
+		return s.cfg.Interval
+	}
+
+	e.backoffStep++
+	delay := s.cfg.Interval + time.Duration(e.backoffStep)*s.cfg.Backoff
+	if delay > s.cfg.MaxBackoff {
+		delay = s.cfg.MaxBackoff
+	}
+	return delay
+}
+
+// RecordForward folds a passive udp-forward outcome into name's error-rate
+// window, demoting it to unhealthy if PassiveErrorThreshold is configured
+// and met or exceeded.
+func (s *Set) RecordForward(name string, success bool) {
+	if s.cfg.PassiveErrorThreshold <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[name]
+	if !ok {
+		e = &entry{}
+		s.entries[name] = e
+	}
+
+	if len(e.passiveOutcomes) < s.cfg.PassiveWindow {
+		e.passiveOutcomes = append(e.passiveOutcomes, success)
+	} else {
+		e.passiveOutcomes[e.passiveNext] = success
+		e.passiveNext = (e.passiveNext + 1) % s.cfg.PassiveWindow
+	}
+
+	if len(e.passiveOutcomes) < s.cfg.PassiveWindow {
+		return
+	}
+
+	failures := 0
+	for _, ok := range e.passiveOutcomes {
+		if !ok {
+			failures++
+		}
+	}
+	rate := float64(failures) / float64(len(e.passiveOutcomes))
+	if rate >= s.cfg.PassiveErrorThreshold {
+		e.status = StatusUnhealthy
+		e.rampWeight = 0
+	}
+}
+
+// Status returns name's current status and ramp weight. The weight is 1.0
+// once healthy, grows through (0,1) while recovering and is 0 for
+// unhealthy/unknown destinations; any failed probe resets it to 0, even one
+// below UnhealthyThreshold that leaves the status unchanged.
+func (s *Set) Status(name string) (Status, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[name]
+	if !ok {
+		return StatusUnknown, 0
+	}
+	return e.status, e.rampWeight
+}
+
+// InRotation reports whether name should currently receive any traffic at
+// all. A destination that has never completed a probe (StatusUnknown) is
+// included, since it's presumed to already be serving live traffic; only a
+// destination that has actively failed enough probes to be StatusUnhealthy
+// is excluded.
+func (s *Set) InRotation(name string) bool {
+	status, _ := s.Status(name)
+	return status != StatusUnhealthy
+}
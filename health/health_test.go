@@ -0,0 +1,218 @@
+package health
+
+import (
+	"testing"
+	"time"
+)
+
+func testConfig() Config {
+	return Config{
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+		Interval:           10 * time.Second,
+		Backoff:            5 * time.Second,
+		MaxBackoff:         20 * time.Second,
+	}
+}
+
+func TestRecordActiveUnknownToHealthyRequiresThreshold(t *testing.T) {
+	s := NewSet(testConfig())
+	s.Sync([]string{"a"})
+
+	now := time.Now()
+	if status, _ := s.Status("a"); status != StatusUnknown {
+		t.Fatalf("initial status = %v, want unknown", status)
+	}
+
+	s.RecordActive("a", true, now)
+	if status, _ := s.Status("a"); status != StatusUnknown {
+		t.Fatalf("status after 1/%d passes = %v, want still unknown", testConfig().HealthyThreshold, status)
+	}
+
+	s.RecordActive("a", true, now)
+	status, ramp := s.Status("a")
+	if status != StatusHealthy || ramp != 1.0 {
+		t.Fatalf("status after threshold passes = (%v, %v), want (healthy, 1.0)", status, ramp)
+	}
+}
+
+func TestRecordActiveHealthyToUnhealthyAfterThreshold(t *testing.T) {
+	s := NewSet(testConfig())
+	s.Sync([]string{"a"})
+	now := time.Now()
+
+	s.RecordActive("a", true, now)
+	s.RecordActive("a", true, now)
+	if status, _ := s.Status("a"); status != StatusHealthy {
+		t.Fatalf("setup: status = %v, want healthy", status)
+	}
+
+	s.RecordActive("a", false, now)
+	if status, _ := s.Status("a"); status != StatusHealthy {
+		t.Fatalf("status after 1 failure = %v, want still healthy (threshold is 2)", status)
+	}
+
+	s.RecordActive("a", false, now)
+	if status, ramp := s.Status("a"); status != StatusUnhealthy || ramp != 0 {
+		t.Fatalf("status after threshold failures = (%v, %v), want (unhealthy, 0)", status, ramp)
+	}
+}
+
+func TestRecordActiveRampsThroughRecoveringBeforeHealthy(t *testing.T) {
+	s := NewSet(testConfig())
+	s.Sync([]string{"a"})
+	now := time.Now()
+	threshold := testConfig().HealthyThreshold
+
+	// Drive to unhealthy first.
+	s.RecordActive("a", false, now)
+	s.RecordActive("a", false, now)
+	if status, _ := s.Status("a"); status != StatusUnhealthy {
+		t.Fatalf("setup: status = %v, want unhealthy", status)
+	}
+
+	// HealthyThreshold consecutive passes move Unhealthy -> Recovering, at
+	// a ramp weight of 1/HealthyThreshold rather than straight to Healthy.
+	for i := 0; i < threshold; i++ {
+		s.RecordActive("a", true, now)
+	}
+	status, ramp := s.Status("a")
+	if status != StatusRecovering {
+		t.Fatalf("status after %d recovery passes = %v, want recovering", threshold, status)
+	}
+	if want := 1.0 / float64(threshold); ramp != want {
+		t.Fatalf("ramp weight entering recovering = %v, want %v", ramp, want)
+	}
+
+	// Each further pass adds 1/HealthyThreshold, so HealthyThreshold-1
+	// more passes ramp it fully up to Healthy; another HealthyThreshold
+	// passes leave it there.
+	for i := 0; i < threshold; i++ {
+		s.RecordActive("a", true, now)
+	}
+	status, ramp = s.Status("a")
+	if status != StatusHealthy || ramp != 1.0 {
+		t.Fatalf("status after full ramp = (%v, %v), want (healthy, 1.0)", status, ramp)
+	}
+}
+
+func TestRecordActiveFailureDuringRecoveryResetsRamp(t *testing.T) {
+	s := NewSet(testConfig())
+	s.Sync([]string{"a"})
+	now := time.Now()
+	threshold := testConfig().HealthyThreshold
+
+	s.RecordActive("a", false, now)
+	s.RecordActive("a", false, now)
+	for i := 0; i < threshold; i++ {
+		s.RecordActive("a", true, now)
+	}
+	if status, _ := s.Status("a"); status != StatusRecovering {
+		t.Fatalf("setup: status = %v, want recovering", status)
+	}
+
+	s.RecordActive("a", false, now)
+	status, ramp := s.Status("a")
+	if ramp != 0 {
+		t.Fatalf("ramp weight after a failure = %v, want 0", ramp)
+	}
+	// UnhealthyThreshold is 2 consecutive failures; only one has happened
+	// since the last pass, so it isn't unhealthy yet.
+	if status != StatusRecovering {
+		t.Fatalf("status after 1 failure during recovery = %v, want still recovering", status)
+	}
+}
+
+func TestBackoffForGrowsWithConsecutiveFailuresAndCapsAtMaxBackoff(t *testing.T) {
+	s := NewSet(testConfig())
+	s.Sync([]string{"a"})
+	now := time.Now()
+
+	s.RecordActive("a", false, now)
+	s.RecordActive("a", false, now)
+	firstEntry := s.entries["a"]
+	if status, _ := s.Status("a"); status != StatusUnhealthy {
+		t.Fatalf("setup: status = %v, want unhealthy", status)
+	}
+	firstDelay := firstEntry.nextCheck.Sub(now)
+	if want := testConfig().Interval + testConfig().Backoff; firstDelay != want {
+		t.Fatalf("first backoff delay = %v, want %v", firstDelay, want)
+	}
+
+	s.RecordActive("a", false, now)
+	secondDelay := firstEntry.nextCheck.Sub(now)
+	if secondDelay <= firstDelay {
+		t.Fatalf("backoff delay did not grow: first=%v second=%v", firstDelay, secondDelay)
+	}
+
+	for i := 0; i < 10; i++ {
+		s.RecordActive("a", false, now)
+	}
+	if delay := firstEntry.nextCheck.Sub(now); delay > testConfig().MaxBackoff {
+		t.Fatalf("backoff delay %v exceeded MaxBackoff %v", delay, testConfig().MaxBackoff)
+	}
+}
+
+func TestInRotationExcludesOnlyUnhealthy(t *testing.T) {
+	s := NewSet(testConfig())
+	s.Sync([]string{"unknown", "unhealthy"})
+	now := time.Now()
+
+	s.RecordActive("unhealthy", false, now)
+	s.RecordActive("unhealthy", false, now)
+
+	if !s.InRotation("unknown") {
+		t.Error("never-probed destination should be InRotation")
+	}
+	if s.InRotation("unhealthy") {
+		t.Error("unhealthy destination should not be InRotation")
+	}
+}
+
+func TestRecordForwardPassiveErrorThreshold(t *testing.T) {
+	cfg := testConfig()
+	cfg.PassiveErrorThreshold = 0.5
+	cfg.PassiveWindow = 4
+	s := NewSet(cfg)
+	s.Sync([]string{"a"})
+
+	s.RecordForward("a", true)
+	s.RecordForward("a", true)
+	s.RecordForward("a", true)
+	if status, _ := s.Status("a"); status == StatusUnhealthy {
+		t.Fatalf("status went unhealthy before the window filled: %v", status)
+	}
+
+	s.RecordForward("a", false)
+	s.RecordForward("a", false)
+	if status, _ := s.Status("a"); status != StatusUnhealthy {
+		t.Fatalf("status = %v, want unhealthy once the error rate meets the threshold", status)
+	}
+}
+
+func TestRecordForwardNoopWhenThresholdUnset(t *testing.T) {
+	s := NewSet(testConfig())
+	s.Sync([]string{"a"})
+
+	for i := 0; i < 10; i++ {
+		s.RecordForward("a", false)
+	}
+	if status, _ := s.Status("a"); status != StatusUnknown {
+		t.Fatalf("status = %v, want unchanged (passive tracking disabled)", status)
+	}
+}
+
+func TestSyncDropsStaleEntries(t *testing.T) {
+	s := NewSet(testConfig())
+	s.Sync([]string{"a", "b"})
+	s.RecordActive("a", false, time.Now())
+
+	s.Sync([]string{"b"})
+
+	if _, ok := s.entries["a"]; ok {
+		t.Error("Sync should have dropped the entry for a")
+	}
+	if status, _ := s.Status("a"); status != StatusUnknown {
+		t.Errorf("Status for a dropped entry = %v, want unknown (zero value)", status)
+	}
+}
@@ -7,51 +7,284 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/lrascao/dnsproxy/discovery"
+	"github.com/lrascao/dnsproxy/grpcapi"
+	"github.com/lrascao/dnsproxy/health"
+	"github.com/lrascao/dnsproxy/logging"
+	"github.com/lrascao/dnsproxy/metrics"
+	"github.com/lrascao/dnsproxy/policy"
+	"github.com/lrascao/dnsproxy/server"
+	"github.com/lrascao/dnsproxy/upstream"
 	forward "github.com/lrascao/udp-forward"
 	"github.com/miekg/dns"
 	"github.com/spf13/viper"
+	"google.golang.org/grpc"
 )
 
 type destination struct {
-	Name    string `json:"name"`
-	Address string `json:"addr"`
+	Name      string `json:"name"`
+	Address   string `json:"addr"`
+	Weight    int    `json:"weight,omitempty"`
+	Priority  int    `json:"priority,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
+	Bootstrap string `json:"bootstrap,omitempty"`
+
+	latency *policy.EWMA
+}
+
+// usesSecureTransport reports whether d must be reached over a real DNS
+// server/client connection (TCP, DoT, DoH, DoQ) rather than udp-forward's
+// packet-level UDP mirroring.
+func (d destination) usesSecureTransport() bool {
+	switch upstream.Protocol(d.Protocol) {
+	case "", upstream.UDP:
+		return false
+	default:
+		return true
+	}
 }
 
 type config struct {
 	Log struct {
-		Level string `yaml:"level"`
+		Level    string `yaml:"level"`
+		Mode     string `yaml:"mode,omitempty"`
+		Sampling uint32 `yaml:"sampling,omitempty"`
 	} `yaml:"log"`
 	Forward struct {
-		Port   int `yaml:"port"`
+		Port   int    `yaml:"port"`
+		Policy string `yaml:"policy,omitempty"`
 		Static []struct {
-			Name    string `yaml:"name"`
-			Address string `yaml:"address"`
+			Name      string `yaml:"name"`
+			Address   string `yaml:"address"`
+			Weight    int    `yaml:"weight,omitempty"`
+			Priority  int    `yaml:"priority,omitempty"`
+			Protocol  string `yaml:"protocol,omitempty"`
+			Bootstrap string `yaml:"bootstrap,omitempty"`
 		} `yaml:"static,omitempty"`
 	} `yaml:"forward"`
 	Admin struct {
 		Port  int    `yaml:"port"`
 		Token string `yaml:"token"`
+		// GRPCPort, if set, also serves the Admin gRPC API (grpcapi
+		// package) on this port, authorized by the same Token.
+		GRPCPort int `yaml:"grpcPort,omitempty"`
 	} `yaml:"admin"`
 	HealthCheck struct {
-		Period time.Duration `yaml:"period"`
-		Domain string        `yaml:"domain"`
+		Period                time.Duration `yaml:"period"`
+		Domain                string        `yaml:"domain"`
+		HealthyThreshold      int           `mapstructure:"healthy_threshold" yaml:"healthy_threshold,omitempty"`
+		UnhealthyThreshold    int           `mapstructure:"unhealthy_threshold" yaml:"unhealthy_threshold,omitempty"`
+		Timeout               time.Duration `yaml:"timeout,omitempty"`
+		Backoff               time.Duration `yaml:"backoff,omitempty"`
+		MaxBackoff            time.Duration `mapstructure:"max_backoff" yaml:"max_backoff,omitempty"`
+		Probe                 string        `yaml:"probe,omitempty"`
+		PassiveErrorThreshold float64       `mapstructure:"passive_error_threshold" yaml:"passive_error_threshold,omitempty"`
+		PassiveWindow         int           `mapstructure:"passive_window" yaml:"passive_window,omitempty"`
 	} `yaml:"healthCheck"`
+	Discovery struct {
+		// File, when watch is true, re-reads forward.static whenever the
+		// config file changes on disk.
+		File struct {
+			Watch bool `yaml:"watch,omitempty"`
+		} `yaml:"file,omitempty"`
+		// SRV periodically resolves a DNS SRV record and treats each
+		// record as a destination.
+		SRV struct {
+			Name     string        `yaml:"name,omitempty"`
+			Interval time.Duration `yaml:"interval,omitempty"`
+		} `yaml:"srv,omitempty"`
+		// Consul watches a Consul service via blocking catalog queries.
+		Consul struct {
+			Address    string        `yaml:"address,omitempty"`
+			Service    string        `yaml:"service,omitempty"`
+			Datacenter string        `yaml:"datacenter,omitempty"`
+			Wait       time.Duration `yaml:"wait,omitempty"`
+		} `yaml:"consul,omitempty"`
+		// Debounce is how long to wait after the last change from any
+		// source before applying a merged update, so a burst of changes
+		// only triggers one forwarder/server update.
+		Debounce time.Duration `yaml:"debounce,omitempty"`
+	} `yaml:"discovery,omitempty"`
+}
+
+// healthConfig adapts the YAML healthCheck section to a health.Config.
+func (c config) healthConfig() health.Config {
+	return health.Config{
+		HealthyThreshold:      c.HealthCheck.HealthyThreshold,
+		UnhealthyThreshold:    c.HealthCheck.UnhealthyThreshold,
+		Timeout:               c.HealthCheck.Timeout,
+		Interval:              c.HealthCheck.Period,
+		Backoff:               c.HealthCheck.Backoff,
+		MaxBackoff:            c.HealthCheck.MaxBackoff,
+		Probe:                 health.Probe(c.HealthCheck.Probe),
+		PassiveErrorThreshold: c.HealthCheck.PassiveErrorThreshold,
+		PassiveWindow:         c.HealthCheck.PassiveWindow,
+	}
+}
+
+// destinationSet holds the configured destinations alongside their
+// per-destination health-check state (consecutive pass/fail counts,
+// backoff, and ramp-up weight while recovering).
+type destinationSet struct {
+	mu     sync.Mutex
+	byName map[string]destination
+	order  []string
+	health *health.Set
+}
+
+func newDestinationSet(cfg health.Config) *destinationSet {
+	return &destinationSet{
+		byName: make(map[string]destination),
+		health: health.NewSet(cfg),
+	}
+}
+
+// Replace swaps in a new list of destinations, preserving health state and
+// the accumulated latency EWMA for any destination name that persists
+// across the change, so a discovery source re-reporting the same names
+// (e.g. an SRV re-resolve that found no change) doesn't reset least_latency
+// back to zero samples every Interval.
+func (s *destinationSet) Replace(destinations []destination) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byName := make(map[string]destination, len(destinations))
+	order := make([]string, 0, len(destinations))
+	for _, d := range destinations {
+		// Every destination constructor (static config, discovery
+		// sources, REST/gRPC admin) hands Replace a fresh EWMA; carry
+		// over the one already being accumulated for this name instead,
+		// if this isn't the first time it's been seen.
+		if existing, ok := s.byName[d.Name]; ok && existing.latency != nil {
+			d.latency = existing.latency
+		}
+		byName[d.Name] = d
+		order = append(order, d.Name)
+	}
+	s.byName = byName
+	s.order = order
+	s.health.Sync(s.order)
+}
+
+// All returns every configured destination, regardless of health.
+func (s *destinationSet) All() []destination {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]destination, 0, len(s.order))
+	for _, name := range s.order {
+		out = append(out, s.byName[name])
+	}
+	return out
+}
+
+// DueActive returns the destinations due for their next active probe.
+func (s *destinationSet) DueActive(now time.Time) []destination {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []destination
+	for _, name := range s.health.DueActive(now) {
+		if d, ok := s.byName[name]; ok {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// RecordActive folds the result of an active probe started at now into
+// name's state machine.
+func (s *destinationSet) RecordActive(name string, passed bool, now time.Time) {
+	s.health.RecordActive(name, passed, now)
+}
+
+// RecordForward folds a passive udp-forward outcome into name's state
+// machine.
+func (s *destinationSet) RecordForward(name string, success bool) {
+	s.health.RecordForward(name, success)
 }
 
+// InRotation returns the destinations currently eligible to receive
+// traffic, with Weight scaled down for ones still ramping back up after a
+// recovery. StatusUnknown destinations (never yet probed) are included at
+// full weight rather than excluded, since they're already receiving live
+// traffic from the moment the forwarder/server starts: requiring
+// HealthyThreshold clean passes before admitting them would otherwise drop
+// every destination out of rotation for a whole HealthCheck.Period on every
+// start or destination-set replace.
+func (s *destinationSet) InRotation() []destination {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []destination
+	for _, name := range s.order {
+		status, ramp := s.health.Status(name)
+		if status == health.StatusUnhealthy {
+			continue
+		}
+		d := s.byName[name]
+		if status == health.StatusRecovering {
+			d.Weight = rampedWeight(d.Weight, ramp)
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// StatusOf returns name's current health status, for callers (like the
+// gRPC WatchStatus stream) that want the raw state rather than the
+// rotation-filtered destination list InRotation returns.
+func (s *destinationSet) StatusOf(name string) health.Status {
+	status, _ := s.health.Status(name)
+	return status
+}
+
+// rampedWeight scales weight down by ramp (0,1], always leaving at least 1
+// so a recovering destination can still receive some traffic.
+func rampedWeight(weight int, ramp float64) int {
+	if weight <= 0 {
+		weight = 1
+	}
+	scaled := int(float64(weight) * ramp)
+	if scaled < 1 {
+		scaled = 1
+	}
+	return scaled
+}
+
+// selectionInterval is how often the plain-UDP path re-applies the
+// configured forward.policy to the destinations currently in rotation,
+// independent of HealthCheck.Period. It's deliberately short and fixed
+// rather than user-configurable: forward.Forwarder mirrors to whatever
+// destination set it was last given between updates, so round_robin and
+// weighted_random rotate on this cadence, not per individual query; making
+// the cadence shorter gets closer to per-query without the rewrite that
+// true per-query selection on the udp-forward mirroring path would need.
+const selectionInterval = 1 * time.Second
+
 type runner struct {
 	cfg          config
-	destinations []destination
+	destinations *destinationSet
+	selector     policy.Selector
+	metrics      *metrics.Metrics
+	controller   *controller
+
+	mu          sync.Mutex
+	connections map[string]connection
+	lastHealthy int
+
+	probeMu        sync.Mutex
+	probeUpstreams map[string]upstream.Upstream
 }
 
 func main() {
-	ctx := context.Background()
-
 	// read config argument from command line
 	var configFile string
 	flag.StringVar(&configFile, "config", "config.yaml", "config file")
@@ -73,57 +306,98 @@ func main() {
 		panic(err)
 	}
 
-	logHandler := slog.NewTextHandler(os.Stdout,
-		&slog.HandlerOptions{
-			Level:     toLevelDebug(cfg.Log.Level),
-			AddSource: true,
-		})
-	log := slog.New(logHandler)
-	slog.SetDefault(log)
+	log := logging.New(logging.Config{
+		Level:  cfg.Log.Level,
+		Mode:   cfg.Log.Mode,
+		Sample: cfg.Log.Sampling,
+	}, os.Stdout)
+	ctx := logging.WithLogger(context.Background(), log)
 
-	slog.Debug("config", "config", cfg)
+	log.Debug().Interface("config", cfg).Msg("config")
 
 	runner := &runner{
-		cfg: cfg,
+		cfg:            cfg,
+		metrics:        metrics.New(),
+		connections:    make(map[string]connection),
+		probeUpstreams: make(map[string]upstream.Upstream),
 	}
 	if err := runner.Run(ctx); err != nil {
-		slog.Error("error running runner", "error", err)
+		log.Error().Err(err).Msg("error running runner")
 		os.Exit(1)
 	}
 }
 
 func (r *runner) Run(ctx context.Context) error {
-	updateDstCh := make(chan []destination)
-	if r.cfg.Admin.Port != 0 {
-		r.serveHTTP(ctx, updateDstCh)
-	}
+	log := logging.FromContext(ctx)
 
 	opts := []forward.Option{
 		forward.WithTimeout(30 * time.Second),
 		forward.WithConnectCallback(func(addr string) {
-			slog.Debug("connected", "from", addr)
+			r.onConnect(ctx, addr)
 		}),
 		forward.WithDisconnectCallback(func(addr string) {
-			slog.Debug("disconnected", "from", addr)
+			r.onDisconnect(ctx, addr)
 		}),
 	}
 
+	var destinations []destination
 	if len(r.cfg.Forward.Static) != 0 {
 		for _, static := range r.cfg.Forward.Static {
 			if static.Name == "" || static.Address == "" {
-				slog.Warn("skipping static destination with empty name or address",
-					"name", static.Name, "addr", static.Address)
+				log.Warn().Str("name", static.Name).Str("addr", static.Address).
+					Msg("skipping static destination with empty name or address")
 				continue
 			}
-			r.destinations = append(r.destinations,
+			destinations = append(destinations,
 				destination{
-					Name:    static.Name,
-					Address: static.Address,
+					Name:      static.Name,
+					Address:   static.Address,
+					Weight:    static.Weight,
+					Priority:  static.Priority,
+					Protocol:  static.Protocol,
+					Bootstrap: static.Bootstrap,
+					latency:   policy.NewEWMA(0.3),
 				})
 		}
 	}
 
-	for _, dst := range r.destinations {
+	r.destinations = newDestinationSet(r.cfg.healthConfig())
+	r.destinations.Replace(destinations)
+	// Seed /healthz and /readyz from the destinations InRotation already
+	// admits (every never-probed one, per destinationSet.InRotation) rather
+	// than leaving lastHealthy at its zero value: otherwise readiness
+	// reports unhealthy for a full HealthCheck.Period after every start, or
+	// forever if health checks are disabled, despite traffic already being
+	// served.
+	r.setHealthy(len(r.destinations.InRotation()))
+
+	r.selector = policy.New(policy.Name(r.cfg.Forward.Policy))
+
+	updateDstCh := make(chan []destination)
+	r.controller = newController(r.destinations, updateDstCh)
+	if r.cfg.Admin.Port != 0 {
+		r.serveHTTP(ctx)
+	}
+	if r.cfg.Admin.GRPCPort != 0 {
+		r.serveGRPC(ctx, r.cfg.Admin.GRPCPort)
+	}
+	go r.runDiscovery(ctx, updateDstCh)
+
+	src := fmt.Sprintf(":%d", r.cfg.Forward.Port)
+
+	// A destination that requires a secure transport can't be reached by
+	// udp-forward's packet-level mirroring, so if one is among the
+	// destinations configured at startup the whole proxy is served by a
+	// real DNS server that dials the right transport per query instead.
+	// This choice is made once: destinations arriving later through the
+	// admin API or discovery do not switch between the two paths.
+	for _, d := range destinations {
+		if d.usesSecureTransport() {
+			return r.runSecure(ctx, src, updateDstCh)
+		}
+	}
+
+	for _, dst := range destinations {
 		opts = append(opts,
 			forward.WithDestination(
 				dst.Name,
@@ -131,8 +405,6 @@ func (r *runner) Run(ctx context.Context) error {
 			))
 	}
 
-	src := fmt.Sprintf(":%d", r.cfg.Forward.Port)
-
 	forwarder, err := forward.NewForwarder(src, opts...)
 	if err != nil {
 		panic(err)
@@ -140,16 +412,23 @@ func (r *runner) Run(ctx context.Context) error {
 	defer forwarder.Close()
 
 	go func() {
-		fmt.Printf("forwarding UDP on %s to %v\n",
-			src, forwarder.Destinations())
+		log.Info().Str("addr", src).Interface("destinations", forwarder.Destinations()).
+			Msg("forwarding UDP")
 		forwarder.Start(ctx)
 	}()
 
+	// Apply forward.policy immediately and keep re-applying it on its own
+	// cadence, rather than only from inside the health-check ticker: that
+	// would leave the configured policy never applied at all whenever
+	// HealthCheck.Period is 0, and round_robin/weighted_random stuck on one
+	// destination for a whole Period otherwise.
+	r.applySelection(ctx, forwarder)
+	go r.runSelection(ctx, forwarder)
+
 	if r.cfg.HealthCheck.Period > 0 {
 		go func() {
-			fmt.Printf("starting health check every %s on domain %s\n",
-				r.cfg.HealthCheck.Period, r.cfg.HealthCheck.Domain)
-
+			log.Info().Stringer("period", r.cfg.HealthCheck.Period).Str("domain", r.cfg.HealthCheck.Domain).
+				Msg("starting health check")
 			r.healthCheck(ctx, forwarder)
 		}()
 	}
@@ -157,8 +436,15 @@ func (r *runner) Run(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
+			return ctx.Err()
 		case destinations := <-updateDstCh:
-			fmt.Printf("New target destinations: %v\n", destinations)
+			log.Info().Interface("destinations", destinations).Msg("new target destinations")
+			r.destinations.Replace(destinations)
+			r.pruneProbeUpstreams(destinations)
+			// Keep /healthz and /readyz in sync even with health checks
+			// disabled (HealthCheck.Period == 0), where healthCheck's ticker
+			// never runs to call setHealthy itself.
+			r.setHealthy(len(r.destinations.InRotation()))
 			var opts []forward.Option
 			for _, dst := range destinations {
 				opts = append(opts,
@@ -168,37 +454,438 @@ func (r *runner) Run(ctx context.Context) error {
 				)
 			}
 			if err := forwarder.Update(opts...); err != nil {
-				slog.Error("Error updating forwarder", "error", err)
+				log.Error().Err(err).Msg("error updating forwarder")
+			}
+			log.Info().Str("addr", src).Interface("destinations", forwarder.Destinations()).
+				Msg("updated forwarding targets")
+			r.applySelection(ctx, forwarder)
+		}
+	}
+}
+
+// connection tracks when a destination connection was established and the
+// trace ID generated for it, so onDisconnect can report how long it was up
+// for and log under the same trace ID as its matching onConnect.
+type connection struct {
+	at      time.Time
+	traceID string
+}
+
+// onConnect records when a destination connection was established so
+// onDisconnect can report how long it was up for.
+func (r *runner) onConnect(ctx context.Context, addr string) {
+	connCtx, traceID := logging.WithTraceID(ctx)
+
+	r.mu.Lock()
+	r.connections[addr] = connection{at: time.Now(), traceID: traceID}
+	r.mu.Unlock()
+
+	name := r.nameFor(addr)
+	// udp-forward's callback signature doesn't expose the packet itself,
+	// so this is the closest approximation of "a query was forwarded" we
+	// have on the mirroring path; the secure transport path in
+	// server.Server records exact request/response byte counts instead.
+	r.metrics.RecordQuery(name, 0, 0)
+	r.controller.recordQuery(name)
+	// likewise, a successful connect is the only passive signal this
+	// callback gives us; there's no error callback to feed failures into
+	// the passive error-rate check.
+	r.destinations.RecordForward(name, true)
+
+	logger := logging.FromContext(connCtx)
+	logger.Debug().Str("destination", name).Str("addr", addr).
+		Msg("connected")
+}
+
+func (r *runner) onDisconnect(ctx context.Context, addr string) {
+	r.mu.Lock()
+	conn, ok := r.connections[addr]
+	delete(r.connections, addr)
+	r.mu.Unlock()
+
+	// Reuse the trace ID onConnect generated for this same addr, where one
+	// was recorded, so the pair of log lines for one connection share a
+	// trace ID instead of onDisconnect getting a fresh one of its own.
+	logger := logging.FromContext(ctx)
+	if ok && conn.traceID != "" {
+		logger = logger.With().Str("trace_id", conn.traceID).Logger()
+	}
+	event := logger.Debug().Str("destination", r.nameFor(addr)).Str("addr", addr)
+	if ok {
+		event = event.Dur("connected_for", time.Since(conn.at))
+	}
+	event.Msg("disconnected")
+}
+
+// nameFor returns the configured name for the destination at addr, or addr
+// itself if it isn't (or is no longer) one of r.destinations.
+func (r *runner) nameFor(addr string) string {
+	for _, d := range r.destinations.All() {
+		if d.Address == addr {
+			return d.Name
+		}
+	}
+	return addr
+}
+
+// probeUpstreamFor returns the persistent upstream.Upstream used to health
+// check d, dialing and caching one on first use. This mirrors
+// server.Server.upstreamFor's per-destination-name caching so a DoT/DoH/DoQ
+// destination pays its TLS/QUIC handshake once, not on every single
+// HealthCheck.Period tick.
+func (r *runner) probeUpstreamFor(d destination) (upstream.Upstream, error) {
+	r.probeMu.Lock()
+	defer r.probeMu.Unlock()
+
+	if up, ok := r.probeUpstreams[d.Name]; ok {
+		return up, nil
+	}
+
+	up, err := upstream.New(upstream.Protocol(d.Protocol), d.Address, upstream.Bootstrap{Server: d.Bootstrap})
+	if err != nil {
+		return nil, err
+	}
+	r.probeUpstreams[d.Name] = up
+	return up, nil
+}
+
+// pruneProbeUpstreams closes and forgets the cached probe upstream for any
+// destination name no longer in current, so a removed or replaced
+// destination doesn't leak its connection.
+func (r *runner) pruneProbeUpstreams(current []destination) {
+	keep := make(map[string]struct{}, len(current))
+	for _, d := range current {
+		keep[d.Name] = struct{}{}
+	}
+
+	r.probeMu.Lock()
+	defer r.probeMu.Unlock()
+	for name, up := range r.probeUpstreams {
+		if _, ok := keep[name]; !ok {
+			up.Close()
+			delete(r.probeUpstreams, name)
+		}
+	}
+}
+
+// setHealthy records how many destinations are currently in rotation (see
+// destinationSet.InRotation), for /healthz and /readyz to report on.
+func (r *runner) setHealthy(n int) {
+	r.mu.Lock()
+	r.lastHealthy = n
+	r.mu.Unlock()
+}
+
+// isHealthy reports whether at least one destination is currently in
+// rotation, which includes never-probed and recovering ones.
+func (r *runner) isHealthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastHealthy > 0
+}
+
+// broadcastStatus pushes every destination's current health status and
+// most recent QPS sample to the gRPC Admin service's WatchStatus
+// subscribers.
+func (r *runner) broadcastStatus() {
+	qps := r.controller.sampleQPS()
+	for _, d := range r.destinations.All() {
+		r.controller.broadcast(grpcapi.StatusEvent{
+			Destination: d.Name,
+			Status:      r.destinations.StatusOf(d.Name).String(),
+			QPS:         qps[d.Name],
+		})
+	}
+}
+
+// serveGRPC starts the Admin gRPC service (grpcapi package) on port,
+// authorized by the same token as the REST admin endpoint and backed by
+// the same controller, so both surfaces operate on one destination set.
+func (r *runner) serveGRPC(ctx context.Context, port int) {
+	log := logging.FromContext(ctx)
+
+	unary, stream := grpcapi.TokenInterceptors(r.cfg.Admin.Token)
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(unary),
+		grpc.StreamInterceptor(stream),
+	)
+	grpcapi.RegisterAdminServer(srv, grpcapi.NewServer(grpcController{r.controller}))
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Error().Err(err).Int("port", port).Msg("error listening on admin gRPC port")
+		return
+	}
+
+	log.Info().Int("port", port).Msg("admin gRPC running")
+	go func() {
+		if err := srv.Serve(lis); err != nil {
+			log.Error().Err(err).Msg("error serving admin gRPC")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+}
+
+// runSecure serves every destination through a server.Server instead of
+// udp-forward, used whenever at least one destination is configured with a
+// protocol other than plain UDP.
+func (r *runner) runSecure(ctx context.Context, src string, updateDstCh chan []destination) error {
+	log := logging.FromContext(ctx)
+
+	srv := server.New(src, r.selector, toTargets(r.destinations.All()))
+	srv.OnQuery = func(destination string, reqBytes, respBytes int) {
+		r.metrics.RecordQuery(destination, reqBytes, respBytes)
+		r.controller.recordQuery(destination)
+	}
+	defer srv.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Info().Str("addr", src).Int("destinations", len(r.destinations.All())).
+			Msg("serving DNS over secure transports")
+		errCh <- srv.ListenAndServe(ctx)
+	}()
+
+	if r.cfg.HealthCheck.Period > 0 {
+		go func() {
+			log.Info().Stringer("period", r.cfg.HealthCheck.Period).Str("domain", r.cfg.HealthCheck.Domain).
+				Msg("starting health check")
+			r.healthCheckSecure(ctx, srv)
+		}()
+	}
+
+	for {
+		select {
+		case err := <-errCh:
+			return err
+		case destinations := <-updateDstCh:
+			r.destinations.Replace(destinations)
+			r.pruneProbeUpstreams(destinations)
+			// Keep /healthz and /readyz in sync even with health checks
+			// disabled, where healthCheckSecure's ticker never runs to call
+			// setHealthy itself.
+			r.setHealthy(len(r.destinations.InRotation()))
+			// Read back from r.destinations rather than using the incoming
+			// list, so latency EWMAs that Replace carried over are kept.
+			srv.SetTargets(toTargets(r.destinations.All()))
+			log.Info().Interface("destinations", destinations).Msg("updated secure transport targets")
+		}
+	}
+}
+
+// healthCheckSecure mirrors healthCheck but re-selects the target set on a
+// server.Server rather than a forward.Forwarder, driven by the same
+// per-destination threshold/backoff/ramp state machine.
+func (r *runner) healthCheckSecure(ctx context.Context, srv *server.Server) {
+	log := logging.FromContext(ctx)
+
+	ticker := time.NewTicker(r.cfg.HealthCheck.Period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, d := range r.destinations.DueActive(now) {
+				err := r.checkDNS(ctx, d)
+				r.destinations.RecordActive(d.Name, err == nil, now)
+				if err != nil {
+					log.Error().Err(err).Str("destination", d.Address).Msg("health check failed")
+				}
 			}
-			fmt.Printf("update: forwarding UDP on %s to %v\n",
-				src, forwarder.Destinations())
+
+			inRotation := r.destinations.InRotation()
+			r.setHealthy(len(inRotation))
+			srv.SetTargets(toTargets(inRotation))
+			r.broadcastStatus()
+			log.Info().Interface("in_rotation", inRotation).Msg("health check completed")
 		}
 	}
 }
 
-func (r *runner) serveHTTP(ctx context.Context, ch chan []destination) {
+// toTargets adapts the runner's destinations to the shape server.Server
+// dispatches over.
+func toTargets(destinations []destination) []server.Target {
+	out := make([]server.Target, 0, len(destinations))
+	for _, d := range destinations {
+		latency := time.Duration(0)
+		if d.latency != nil {
+			latency = d.latency.Value()
+		}
+		out = append(out, server.Target{
+			Destination: policy.Destination{
+				Name:     d.Name,
+				Address:  d.Address,
+				Weight:   d.Weight,
+				Priority: d.Priority,
+				Latency:  latency,
+			},
+			Protocol:  upstream.Protocol(d.Protocol),
+			Bootstrap: upstream.Bootstrap{Server: d.Bootstrap},
+		})
+	}
+	return out
+}
+
+// runDiscovery wires together whichever discovery sources are configured
+// (file watch, DNS SRV, Consul) and forwards their merged, debounced
+// target list onto updateDstCh, the same channel the admin API writes to.
+// It returns immediately if no source is configured.
+func (r *runner) runDiscovery(ctx context.Context, updateDstCh chan<- []destination) {
+	log := logging.FromContext(ctx)
+
+	var sources []discovery.Source
+	if r.cfg.Discovery.File.Watch {
+		sources = append(sources, fileSource{cfg: &r.cfg})
+	}
+	if r.cfg.Discovery.SRV.Name != "" {
+		sources = append(sources, discovery.SRVSource{
+			Name:     r.cfg.Discovery.SRV.Name,
+			Interval: r.cfg.Discovery.SRV.Interval,
+		})
+	}
+	if r.cfg.Discovery.Consul.Service != "" {
+		sources = append(sources, discovery.ConsulSource{
+			Address:    r.cfg.Discovery.Consul.Address,
+			Service:    r.cfg.Discovery.Consul.Service,
+			Datacenter: r.cfg.Discovery.Consul.Datacenter,
+			Wait:       r.cfg.Discovery.Consul.Wait,
+		})
+	}
+	if len(sources) == 0 {
+		return
+	}
+
+	debounce := r.cfg.Discovery.Debounce
+	if debounce <= 0 {
+		debounce = 2 * time.Second
+	}
+
+	log.Info().Int("sources", len(sources)).Stringer("debounce", debounce).Msg("starting destination discovery")
+	for targets := range discovery.Coalesce(ctx, sources, debounce) {
+		select {
+		case updateDstCh <- toDestinationsFromTargets(targets):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// toDestinationsFromTargets adapts discovery.Target, the common shape every
+// discovery source reports, to the runner's internal destination type.
+func toDestinationsFromTargets(targets []discovery.Target) []destination {
+	out := make([]destination, 0, len(targets))
+	for _, t := range targets {
+		out = append(out, destination{
+			Name:      t.Name,
+			Address:   t.Address,
+			Weight:    t.Weight,
+			Priority:  t.Priority,
+			Protocol:  t.Protocol,
+			Bootstrap: t.Bootstrap,
+			latency:   policy.NewEWMA(0.3),
+		})
+	}
+	return out
+}
+
+// fileSource is a discovery.Source backed by viper.WatchConfig, re-reading
+// forward.static out of cfg whenever the config file changes on disk. It
+// lives here rather than in the discovery package because it reloads into
+// the same config struct main already unmarshals into.
+type fileSource struct {
+	cfg *config
+}
+
+func (f fileSource) Watch(ctx context.Context, ch chan<- []discovery.Target) {
+	send := func() {
+		if err := viper.Unmarshal(f.cfg); err != nil {
+			logger := logging.FromContext(ctx)
+			logger.Error().Err(err).Msg("error reloading config file")
+			return
+		}
+
+		targets := make([]discovery.Target, 0, len(f.cfg.Forward.Static))
+		for _, static := range f.cfg.Forward.Static {
+			if static.Name == "" || static.Address == "" {
+				continue
+			}
+			targets = append(targets, discovery.Target{
+				Name:      static.Name,
+				Address:   static.Address,
+				Weight:    static.Weight,
+				Priority:  static.Priority,
+				Protocol:  static.Protocol,
+				Bootstrap: static.Bootstrap,
+			})
+		}
+
+		select {
+		case ch <- targets:
+		case <-ctx.Done():
+		}
+	}
+
+	viper.OnConfigChange(func(fsnotify.Event) { send() })
+	viper.WatchConfig()
+
+	send()
+	<-ctx.Done()
+}
+
+func (r *runner) serveHTTP(ctx context.Context) {
+	log := logging.FromContext(ctx)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/",
 		func(w http.ResponseWriter, req *http.Request) {
+			reqCtx, traceID := logging.WithTraceID(req.Context())
+			reqLog := logging.FromContext(reqCtx)
+			w.Header().Set("X-Trace-Id", traceID)
+
 			// authorize request
 			if secret := req.Header.Get("Authorization"); secret != r.cfg.Admin.Token {
+				r.metrics.AdminAuthFailures.Inc()
+				reqLog.Warn().Msg("admin API auth failure")
 				http.Error(w, "unauthorized", http.StatusUnauthorized)
 				return
 			}
 			// read the whole body into a string
 			body, err := ioutil.ReadAll(req.Body)
 			if err != nil {
+				reqLog.Error().Err(err).Msg("error reading admin API request body")
 				http.Error(w, "error reading body", http.StatusInternalServerError)
 				return
 			}
 			var destinations []destination
 			if err := json.Unmarshal(body, &destinations); err != nil {
+				reqLog.Error().Err(err).Msg("error parsing admin API request body")
 				http.Error(w, "error parsing body", http.StatusBadRequest)
 				return
 			}
 
-			ch <- destinations
+			reqLog.Info().Interface("destinations", destinations).Msg("admin API updated destinations")
+			r.controller.Set(destinations)
 		})
+	mux.Handle("/metrics", r.metrics.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		if r.isHealthy() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Error(w, "no healthy destinations", http.StatusServiceUnavailable)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		if r.isHealthy() {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Error(w, "no healthy destinations", http.StatusServiceUnavailable)
+	})
 
 	// create an http server
 	srv := &http.Server{
@@ -209,18 +896,59 @@ func (r *runner) serveHTTP(ctx context.Context, ch chan []destination) {
 		},
 	}
 
-	fmt.Printf("admin HTTP running on :%d\n", r.cfg.Admin.Port)
+	log.Info().Int("port", r.cfg.Admin.Port).Msg("admin HTTP running")
 	go func() {
 		err := srv.ListenAndServe()
 		if errors.Is(err, http.ErrServerClosed) {
-			fmt.Printf("http server closed\n")
+			log.Info().Msg("admin http server closed")
 		} else if err != nil {
-			fmt.Printf("error listening server: %v\n", err)
+			log.Error().Err(err).Msg("error listening on admin http server")
 		}
 	}()
 }
 
+// applySelection re-runs the configured forward.policy over the
+// destinations currently in rotation and pushes the result to f. It's
+// called both immediately and on selectionInterval's own timer, so
+// selection happens independent of whether (or how often) health checks
+// run.
+func (r *runner) applySelection(ctx context.Context, f forward.Forwarder) {
+	log := logging.FromContext(ctx)
+
+	selected := r.selector.Select(toPolicyDestinations(r.destinations.InRotation()))
+
+	var opts []forward.Option
+	for _, d := range selected {
+		opts = append(opts,
+			forward.WithDestination(
+				d.Name,
+				d.Address),
+		)
+	}
+	if err := f.Update(opts...); err != nil {
+		log.Error().Err(err).Msg("error updating forwarder with selected destinations")
+	}
+}
+
+// runSelection calls applySelection every selectionInterval until ctx is
+// done.
+func (r *runner) runSelection(ctx context.Context, f forward.Forwarder) {
+	ticker := time.NewTicker(selectionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.applySelection(ctx, f)
+		}
+	}
+}
+
 func (r *runner) healthCheck(ctx context.Context, f forward.Forwarder) {
+	log := logging.FromContext(ctx)
+
 	ticker := time.NewTicker(r.cfg.HealthCheck.Period)
 	defer ticker.Stop()
 
@@ -228,73 +956,114 @@ func (r *runner) healthCheck(ctx context.Context, f forward.Forwarder) {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			var healthy []destination
-			for _, d := range r.destinations {
-				if err := r.checkDNS(ctx, d); err != nil {
-					slog.Error(fmt.Sprintf("udp-forward: DNS %s health check failed: %v",
-						d.Address, err))
-				} else {
-					healthy = append(healthy, d)
+		case now := <-ticker.C:
+			for _, d := range r.destinations.DueActive(now) {
+				err := r.checkDNS(ctx, d)
+				r.destinations.RecordActive(d.Name, err == nil, now)
+				if err != nil {
+					log.Error().Err(err).Str("destination", d.Address).Msg("udp-forward health check failed")
 				}
 			}
 
-			var opts []forward.Option
-			for _, d := range healthy {
-				opts = append(opts,
-					forward.WithDestination(
-						d.Name,
-						d.Address),
-				)
-			}
-			if err := f.Update(opts...); err != nil {
-				slog.Error("Error updating forwarder with healthy destinations", "error", err)
-			} else {
-				slog.Info("Health check completed", "healthy", healthy)
-			}
+			inRotation := r.destinations.InRotation()
+			r.setHealthy(len(inRotation))
+			r.broadcastStatus()
+
+			// Applying the policy selection itself is runSelection's job,
+			// on its own independent cadence (selectionInterval), not this
+			// ticker's: a health-check-driven destination-set change still
+			// needs an immediate re-select rather than waiting out
+			// selectionInterval, though.
+			r.applySelection(ctx, f)
+
+			log.Info().Interface("in_rotation", inRotation).Msg("health check completed")
 		}
 	}
 }
 
 func (r *runner) checkDNS(ctx context.Context, d destination) error {
-	slog.Debug(fmt.Sprintf("checking DNS %s", d.Address))
+	log := logging.FromContext(ctx)
+
+	probe := health.Probe(r.cfg.HealthCheck.Probe)
+	if probe == "" {
+		probe = health.ProbeA
+	}
+	log.Debug().Str("addr", d.Address).Str("protocol", d.Protocol).Str("probe", string(probe)).
+		Msg("checking DNS")
 
-	ctx, cancel := context.WithTimeout(ctx, time.Duration(15*time.Second))
+	timeout := r.cfg.HealthCheck.Timeout
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	// perform a DNS lookup google.com to this specific server to check if
-	// it is healthy
+	// perform a DNS lookup against this specific server, over whichever
+	// protocol and probe type it is configured for, to check if it is
+	// healthy
+	qtype := dns.TypeA
+	switch probe {
+	case health.ProbeANY:
+		qtype = dns.TypeANY
+	case health.ProbeSOA:
+		qtype = dns.TypeSOA
+	}
 
-	// Create a new DNS message
 	m := new(dns.Msg)
-	m.SetQuestion(r.cfg.HealthCheck.Domain, dns.TypeA)
+	m.SetQuestion(dns.Fqdn(r.cfg.HealthCheck.Domain), qtype)
+
+	up, err := r.probeUpstreamFor(d)
+	if err != nil {
+		r.metrics.RecordHealthCheck(d.Name, false)
+		return fmt.Errorf("building upstream for %s: %w", d.Address, err)
+	}
 
-	// Create a DNS client
-	client := new(dns.Client)
-	// Send the query
-	reply, _, err := client.Exchange(m, d.Address)
+	start := time.Now()
+	reply, err := up.Exchange(ctx, m)
+	rtt := time.Since(start)
+	r.metrics.CheckDNSDuration.WithLabelValues(d.Name).Observe(rtt.Seconds())
 	if err != nil {
+		r.metrics.RecordHealthCheck(d.Name, false)
 		return fmt.Errorf("error querying DNS %s: %w", d.Address, err)
 	}
-	// Check for response
-	if len(reply.Answer) == 0 {
+
+	// dns_any expects the server to be reachable and respond, even with
+	// REFUSED, which many resolvers return for ANY queries while still
+	// being perfectly healthy; every other probe expects a real answer.
+	if probe == health.ProbeANY {
+		if reply.Rcode != dns.RcodeRefused && len(reply.Answer) == 0 {
+			r.metrics.RecordHealthCheck(d.Name, false)
+			return fmt.Errorf("no answer received from DNS %s", d.Address)
+		}
+	} else if len(reply.Answer) == 0 {
+		r.metrics.RecordHealthCheck(d.Name, false)
 		return fmt.Errorf("no answer received from DNS %s", d.Address)
 	}
 
+	if d.latency != nil {
+		d.latency.Update(rtt)
+	}
+	r.metrics.RecordHealthCheck(d.Name, true)
+
 	return nil
 }
 
-func toLevelDebug(lvl string) slog.Level {
-	switch lvl {
-	case "debug":
-		return slog.LevelDebug
-	case "info":
-		return slog.LevelInfo
-	case "warn":
-		return slog.LevelWarn
-	case "error":
-		return slog.LevelError
-	default:
-		return slog.LevelInfo
+// toPolicyDestinations adapts the runner's internal destination slice to
+// the shape the policy package selects over.
+func toPolicyDestinations(destinations []destination) []policy.Destination {
+	out := make([]policy.Destination, 0, len(destinations))
+	for _, d := range destinations {
+		latency := time.Duration(0)
+		if d.latency != nil {
+			latency = d.latency.Value()
+		}
+		out = append(out, policy.Destination{
+			Name:     d.Name,
+			Address:  d.Address,
+			Weight:   d.Weight,
+			Priority: d.Priority,
+			Latency:  latency,
+		})
 	}
+	return out
 }
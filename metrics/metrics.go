@@ -0,0 +1,103 @@
+// Package metrics exposes dnsproxy's Prometheus instrumentation: counters
+// for forwarded queries, bytes, health-check outcomes and admin API auth
+// failures, plus a histogram of checkDNS round-trip durations.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds every collector dnsproxy registers. It is safe for
+// concurrent use; the zero value is not usable, construct with New.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	QueriesForwarded   *prometheus.CounterVec
+	BytesIn            *prometheus.CounterVec
+	BytesOut           *prometheus.CounterVec
+	HealthCheckResults *prometheus.CounterVec
+	AdminAuthFailures  prometheus.Counter
+	CheckDNSDuration   *prometheus.HistogramVec
+}
+
+// New creates and registers dnsproxy's collectors on a fresh registry.
+func New() *Metrics {
+	registry := prometheus.NewRegistry()
+
+	m := &Metrics{
+		registry: registry,
+		QueriesForwarded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dnsproxy",
+			Name:      "queries_forwarded_total",
+			Help:      "Number of DNS queries forwarded, per destination.",
+		}, []string{"destination"}),
+		BytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dnsproxy",
+			Name:      "bytes_in_total",
+			Help:      "Bytes received from upstream destinations.",
+		}, []string{"destination"}),
+		BytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dnsproxy",
+			Name:      "bytes_out_total",
+			Help:      "Bytes sent to upstream destinations.",
+		}, []string{"destination"}),
+		HealthCheckResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "dnsproxy",
+			Name:      "health_check_results_total",
+			Help:      "Health check outcomes, per destination and result (pass/fail).",
+		}, []string{"destination", "result"}),
+		AdminAuthFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "dnsproxy",
+			Name:      "admin_auth_failures_total",
+			Help:      "Admin API requests rejected for a missing or incorrect token.",
+		}),
+		CheckDNSDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "dnsproxy",
+			Name:      "check_dns_duration_seconds",
+			Help:      "Round-trip duration of health-check DNS queries, per destination.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"destination"}),
+	}
+
+	registry.MustRegister(
+		m.QueriesForwarded,
+		m.BytesIn,
+		m.BytesOut,
+		m.HealthCheckResults,
+		m.AdminAuthFailures,
+		m.CheckDNSDuration,
+	)
+
+	return m
+}
+
+// Handler returns the http.Handler to serve /metrics with.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// RecordHealthCheck records a pass/fail outcome for a destination's health
+// check.
+func (m *Metrics) RecordHealthCheck(destination string, healthy bool) {
+	result := "fail"
+	if healthy {
+		result = "pass"
+	}
+	m.HealthCheckResults.WithLabelValues(destination, result).Inc()
+}
+
+// RecordQuery records a forwarded query for destination along with the
+// request/response byte counts, when known (pass 0 for either that
+// couldn't be measured).
+func (m *Metrics) RecordQuery(destination string, reqBytes, respBytes int) {
+	m.QueriesForwarded.WithLabelValues(destination).Inc()
+	if reqBytes > 0 {
+		m.BytesOut.WithLabelValues(destination).Add(float64(reqBytes))
+	}
+	if respBytes > 0 {
+		m.BytesIn.WithLabelValues(destination).Add(float64(respBytes))
+	}
+}
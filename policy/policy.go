@@ -0,0 +1,204 @@
+// Package policy implements destination selection strategies for the
+// dnsproxy forwarder. Rather than always mirroring a query to every
+// configured destination, a Selector picks the subset of destinations that
+// should actually receive the next round of traffic.
+package policy
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Name identifies a selection policy, as configured under forward.policy in
+// the YAML config or via the admin API.
+type Name string
+
+const (
+	RoundRobin     Name = "round_robin"
+	WeightedRandom Name = "weighted_random"
+	LeastLatency   Name = "least_latency"
+	PrimaryBackup  Name = "primary_backup"
+)
+
+// Destination is the subset of destination state a Selector needs in order
+// to make a choice. Latency is the current EWMA health-check round-trip
+// time, zero if no sample has been recorded yet. Priority follows the
+// opposite convention from DNS SRV records: here, higher wins, so
+// primary_backup picks the destination with the largest Priority as
+// primary. Callers feeding in SRV-sourced priorities (where lower is
+// preferred, per RFC 2782) must invert them first; discovery.SRVSource
+// does this when building its Target list.
+type Destination struct {
+	Name     string
+	Address  string
+	Weight   int
+	Priority int
+	Latency  time.Duration
+}
+
+// Selector picks the destinations that should receive the next round of
+// forwarded traffic out of the given healthy candidates. Implementations
+// must be safe for concurrent use.
+type Selector interface {
+	Select(candidates []Destination) []Destination
+}
+
+// New returns the Selector for the given policy name, defaulting to
+// RoundRobin (which, with a single destination, behaves like the previous
+// broadcast-everything behaviour) when name is empty or unrecognised.
+func New(name Name) Selector {
+	switch name {
+	case WeightedRandom:
+		return &weightedRandom{}
+	case LeastLatency:
+		return &leastLatency{}
+	case PrimaryBackup:
+		return &primaryBackup{}
+	case RoundRobin:
+		return &roundRobin{}
+	default:
+		return &roundRobin{}
+	}
+}
+
+type roundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (r *roundRobin) Select(candidates []Destination) []Destination {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next >= len(candidates) {
+		r.next = 0
+	}
+	d := candidates[r.next]
+	r.next++
+
+	return []Destination{d}
+}
+
+type weightedRandom struct{}
+
+func (w *weightedRandom) Select(candidates []Destination) []Destination {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	total := 0
+	for _, d := range candidates {
+		total += weightOf(d)
+	}
+	if total == 0 {
+		return []Destination{candidates[0]}
+	}
+
+	pick := rand.Intn(total)
+	for _, d := range candidates {
+		pick -= weightOf(d)
+		if pick < 0 {
+			return []Destination{d}
+		}
+	}
+
+	return []Destination{candidates[len(candidates)-1]}
+}
+
+func weightOf(d Destination) int {
+	if d.Weight <= 0 {
+		return 1
+	}
+	return d.Weight
+}
+
+type leastLatency struct{}
+
+func (l *leastLatency) Select(candidates []Destination) []Destination {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	best := candidates[0]
+	for _, d := range candidates[1:] {
+		// a destination with no latency sample yet is treated as
+		// unknown rather than infinitely fast, so it only wins
+		// against destinations that are also unmeasured.
+		if d.Latency <= 0 {
+			continue
+		}
+		if best.Latency <= 0 || d.Latency < best.Latency {
+			best = d
+		}
+	}
+
+	return []Destination{best}
+}
+
+type primaryBackup struct{}
+
+func (p *primaryBackup) Select(candidates []Destination) []Destination {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sorted := make([]Destination, len(candidates))
+	copy(sorted, candidates)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+
+	return []Destination{sorted[0]}
+}
+
+// EWMA is an exponentially weighted moving average of health-check round
+// trip times, used by the least_latency policy. The zero value is ready to
+// use and reports a zero Value until the first sample is recorded.
+type EWMA struct {
+	mu     sync.Mutex
+	alpha  float64
+	value  time.Duration
+	primed bool
+}
+
+// NewEWMA returns an EWMA with the given smoothing factor. alpha must be in
+// (0, 1]; higher values weight recent samples more heavily. A zero or
+// out-of-range alpha falls back to 0.3.
+func NewEWMA(alpha float64) *EWMA {
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.3
+	}
+	return &EWMA{alpha: alpha}
+}
+
+// Update folds a new latency sample into the average.
+func (e *EWMA) Update(sample time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.primed {
+		e.value = sample
+		e.primed = true
+		return
+	}
+	alpha := e.alpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.3
+	}
+	e.value = time.Duration(alpha*float64(sample) + (1-alpha)*float64(e.value))
+}
+
+// Value returns the current average, or zero if no sample has been
+// recorded yet.
+func (e *EWMA) Value() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.value
+}
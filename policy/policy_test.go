@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEWMA(t *testing.T) {
+	e := NewEWMA(0.5)
+	if v := e.Value(); v != 0 {
+		t.Fatalf("zero-value EWMA Value() = %v, want 0", v)
+	}
+
+	e.Update(100 * time.Millisecond)
+	if v := e.Value(); v != 100*time.Millisecond {
+		t.Fatalf("first Update should prime the average directly, got %v", v)
+	}
+
+	e.Update(200 * time.Millisecond)
+	if want := 150 * time.Millisecond; e.Value() != want {
+		t.Fatalf("Value() = %v, want %v", e.Value(), want)
+	}
+}
+
+func TestNewEWMADefaultsOutOfRangeAlpha(t *testing.T) {
+	for _, alpha := range []float64{0, -1, 1.5} {
+		e := NewEWMA(alpha)
+		if e.alpha != 0.3 {
+			t.Errorf("NewEWMA(%v).alpha = %v, want 0.3", alpha, e.alpha)
+		}
+	}
+}
+
+func TestRoundRobinCyclesCandidates(t *testing.T) {
+	r := &roundRobin{}
+	candidates := []Destination{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, r.Select(candidates)[0].Name)
+	}
+
+	want := []string{"a", "b", "c", "a"}
+	for i, name := range want {
+		if got[i] != name {
+			t.Fatalf("pick %d = %q, want %q (sequence %v)", i, got[i], name, got)
+		}
+	}
+}
+
+func TestLeastLatencyPrefersLowestMeasuredSample(t *testing.T) {
+	l := &leastLatency{}
+	candidates := []Destination{
+		{Name: "unmeasured"},
+		{Name: "slow", Latency: 50 * time.Millisecond},
+		{Name: "fast", Latency: 10 * time.Millisecond},
+	}
+
+	got := l.Select(candidates)
+	if len(got) != 1 || got[0].Name != "fast" {
+		t.Fatalf("Select() = %v, want [fast]", got)
+	}
+}
+
+func TestLeastLatencyFallsBackToFirstWhenNoneMeasured(t *testing.T) {
+	l := &leastLatency{}
+	candidates := []Destination{{Name: "a"}, {Name: "b"}}
+
+	got := l.Select(candidates)
+	if len(got) != 1 || got[0].Name != "a" {
+		t.Fatalf("Select() = %v, want [a]", got)
+	}
+}
+
+func TestPrimaryBackupPicksHighestPriority(t *testing.T) {
+	p := &primaryBackup{}
+	candidates := []Destination{
+		{Name: "backup", Priority: 1},
+		{Name: "primary", Priority: 10},
+	}
+
+	got := p.Select(candidates)
+	if len(got) != 1 || got[0].Name != "primary" {
+		t.Fatalf("Select() = %v, want [primary]", got)
+	}
+}
+
+func TestWeightedRandomSelectsZeroWeightCandidate(t *testing.T) {
+	w := &weightedRandom{}
+	// A single candidate with a non-positive weight must still be
+	// selectable, per weightOf's floor of 1.
+	candidates := []Destination{{Name: "only", Weight: 0}}
+
+	got := w.Select(candidates)
+	if len(got) != 1 || got[0].Name != "only" {
+		t.Fatalf("Select() = %v, want [only]", got)
+	}
+}
@@ -0,0 +1,199 @@
+// Package server runs a real DNS server (as opposed to udp-forward's
+// packet-level mirroring) that accepts queries from clients over UDP/TCP
+// and dispatches them to a secure upstream transport selected by a
+// policy.Selector.
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/lrascao/dnsproxy/logging"
+	"github.com/lrascao/dnsproxy/policy"
+	"github.com/lrascao/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// Target is a destination this server can dispatch queries to.
+type Target struct {
+	policy.Destination
+	Protocol  upstream.Protocol
+	Bootstrap upstream.Bootstrap
+}
+
+// Server accepts DNS queries on UDP and TCP and forwards each one to the
+// destination chosen by Selector, reusing one upstream.Upstream connection
+// per destination for as long as it stays in the target set.
+type Server struct {
+	Addr     string
+	Selector policy.Selector
+
+	// OnQuery, if set, is called after each successfully dispatched
+	// query with the destination name and the wire size of the request
+	// and response, so callers can wire it into metrics.
+	OnQuery func(destination string, reqBytes, respBytes int)
+
+	mu        sync.Mutex
+	targets   map[string]Target
+	upstreams map[string]upstream.Upstream
+
+	// baseCtx carries the logger ListenAndServe was started with; each
+	// query gets its own trace ID attached on top of it.
+	baseCtx context.Context
+
+	udp *dns.Server
+	tcp *dns.Server
+}
+
+// New returns a Server listening on addr (":53"-style) that will dispatch to
+// the given initial targets.
+func New(addr string, selector policy.Selector, targets []Target) *Server {
+	s := &Server{
+		Addr:      addr,
+		Selector:  selector,
+		targets:   make(map[string]Target),
+		upstreams: make(map[string]upstream.Upstream),
+	}
+	s.SetTargets(targets)
+	return s
+}
+
+// SetTargets atomically replaces the destination set. Upstreams for targets
+// that are no longer present are closed; upstreams for targets that remain
+// are kept, preserving their persistent connection.
+func (s *Server) SetTargets(targets []Target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := make(map[string]Target, len(targets))
+	for _, t := range targets {
+		next[t.Name] = t
+	}
+
+	for name, up := range s.upstreams {
+		if _, ok := next[name]; !ok {
+			up.Close()
+			delete(s.upstreams, name)
+		}
+	}
+
+	s.targets = next
+}
+
+// ListenAndServe starts the UDP and TCP listeners and blocks until ctx is
+// cancelled or a listener fails.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	s.baseCtx = ctx
+	handler := dns.HandlerFunc(s.handle)
+
+	s.udp = &dns.Server{Addr: s.Addr, Net: "udp", Handler: handler}
+	s.tcp = &dns.Server{Addr: s.Addr, Net: "tcp", Handler: handler}
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- s.udp.ListenAndServe() }()
+	go func() { errCh <- s.tcp.ListenAndServe() }()
+
+	select {
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	case err := <-errCh:
+		s.Close()
+		return err
+	}
+}
+
+// Close shuts down both listeners and any open upstream connections.
+func (s *Server) Close() error {
+	if s.udp != nil {
+		s.udp.Shutdown()
+	}
+	if s.tcp != nil {
+		s.tcp.Shutdown()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, up := range s.upstreams {
+		up.Close()
+		delete(s.upstreams, name)
+	}
+
+	return nil
+}
+
+func (s *Server) handle(w dns.ResponseWriter, req *dns.Msg) {
+	defer w.Close()
+
+	base := s.baseCtx
+	if base == nil {
+		base = context.Background()
+	}
+	ctx, _ := logging.WithTraceID(base)
+	log := logging.FromContext(ctx)
+
+	up, name, err := s.upstreamFor()
+	if err != nil {
+		log.Error().Err(err).Msg("no upstream available for query")
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	reply, err := up.Exchange(ctx, req)
+	if err != nil {
+		log.Error().Err(err).Str("destination", name).Msg("upstream exchange failed")
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	reply.SetReply(req)
+	w.WriteMsg(reply)
+
+	if s.OnQuery != nil {
+		s.OnQuery(name, req.Len(), reply.Len())
+	}
+}
+
+// upstreamFor asks the Selector to pick a destination out of the current
+// target set and returns its (lazily dialed, then cached) upstream.
+func (s *Server) upstreamFor() (upstream.Upstream, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	candidates := make([]policy.Destination, 0, len(s.targets))
+	for _, t := range s.targets {
+		candidates = append(candidates, t.Destination)
+	}
+	// Map iteration order is random; sort so order-sensitive selectors
+	// (round_robin, primary_backup ties) see a stable candidate list.
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+
+	selected := s.Selector.Select(candidates)
+	if len(selected) == 0 {
+		return nil, "", fmt.Errorf("no healthy destination to dispatch to")
+	}
+	name := selected[0].Name
+
+	if up, ok := s.upstreams[name]; ok {
+		return up, name, nil
+	}
+
+	target, ok := s.targets[name]
+	if !ok {
+		return nil, "", fmt.Errorf("selected destination %q is no longer configured", name)
+	}
+
+	up, err := upstream.New(target.Protocol, target.Address, target.Bootstrap)
+	if err != nil {
+		return nil, "", fmt.Errorf("dialing upstream %q: %w", name, err)
+	}
+	s.upstreams[name] = up
+
+	return up, name, nil
+}
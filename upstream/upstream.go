@@ -0,0 +1,374 @@
+// Package upstream dials DNS destinations over plain UDP/TCP as well as the
+// encrypted transports (DoT, DoH, DoQ), reusing a persistent connection per
+// destination where the transport supports it.
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// Protocol identifies the transport used to reach a destination.
+type Protocol string
+
+const (
+	UDP   Protocol = "udp"
+	TCP   Protocol = "tcp"
+	TLS   Protocol = "tls"
+	HTTPS Protocol = "https"
+	QUIC  Protocol = "quic"
+)
+
+// Upstream exchanges a single DNS message with a destination and returns its
+// reply. Implementations that hold a persistent connection must be safe for
+// concurrent use and reconnect transparently on failure.
+type Upstream interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	Close() error
+}
+
+// Bootstrap resolves the hostname portion of a DoT/DoH/DoQ destination URL
+// using a plain DNS server, the same way AdGuard Home resolves
+// hostname-based upstreams before dialing them.
+type Bootstrap struct {
+	// Server is a plain "host:port" DNS server, e.g. "8.8.8.8:53".
+	Server string
+}
+
+// Resolve looks up the A record for host via the bootstrap server. If host
+// is already an IP address it is returned unchanged.
+func (b Bootstrap) Resolve(ctx context.Context, host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return host, nil
+	}
+	if b.Server == "" {
+		return "", fmt.Errorf("no bootstrap server configured to resolve %q", host)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+
+	client := &dns.Client{Timeout: 5 * time.Second}
+	reply, _, err := client.ExchangeContext(ctx, m, b.Server)
+	if err != nil {
+		return "", fmt.Errorf("bootstrap resolving %s via %s: %w", host, b.Server, err)
+	}
+	for _, rr := range reply.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("bootstrap %s returned no A record for %s", b.Server, host)
+}
+
+// New dials an Upstream for the given protocol and address. addr is a plain
+// "host:port" for udp/tcp, and a "scheme://host:port" URL (e.g.
+// "tls://1.1.1.1:853" or "https://dns.google/dns-query") for tls/https/quic,
+// per the same convention AdGuard Home uses for upstream URLs. bootstrap is
+// only consulted when the host portion of a tls/https/quic addr is not
+// already an IP literal.
+func New(protocol Protocol, addr string, bootstrap Bootstrap) (Upstream, error) {
+	switch protocol {
+	case "", UDP:
+		return &plainUpstream{net: "udp", addr: addr}, nil
+	case TCP:
+		return &plainUpstream{net: "tcp", addr: addr}, nil
+	case TLS:
+		return newTLSUpstream(addr, bootstrap)
+	case HTTPS:
+		return newHTTPSUpstream(addr, bootstrap)
+	case QUIC:
+		return newQUICUpstream(addr, bootstrap)
+	default:
+		return nil, fmt.Errorf("unsupported upstream protocol %q", protocol)
+	}
+}
+
+// plainUpstream forwards over unencrypted UDP or TCP using a fresh
+// connection per exchange, mirroring the previous health-check behaviour.
+type plainUpstream struct {
+	net  string
+	addr string
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	client := &dns.Client{Net: u.net}
+	reply, _, err := client.ExchangeContext(ctx, m, u.addr)
+	return reply, err
+}
+
+func (u *plainUpstream) Close() error { return nil }
+
+// tlsUpstream is a DNS-over-TLS upstream that keeps a single persistent
+// connection open and re-dials on failure. Exchanges on it are serialized:
+// each holds the connection until its reply has been read.
+type tlsUpstream struct {
+	serverName string
+	dialAddr   string
+
+	mu   sync.Mutex
+	conn *dns.Conn
+}
+
+func newTLSUpstream(addr string, bootstrap Bootstrap) (*tlsUpstream, error) {
+	host, port, serverName, err := splitUpstreamURL(addr, "853")
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := bootstrap.Resolve(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsUpstream{
+		serverName: serverName,
+		dialAddr:   net.JoinHostPort(resolved, port),
+	}, nil
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == nil {
+		tlsConn, err := tls.Dial("tcp", u.dialAddr, &tls.Config{ServerName: u.serverName})
+		if err != nil {
+			return nil, fmt.Errorf("dialing DoT %s: %w", u.dialAddr, err)
+		}
+		u.conn = &dns.Conn{Conn: tlsConn}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = u.conn.SetDeadline(deadline)
+	}
+
+	if err := u.conn.WriteMsg(m); err != nil {
+		u.conn.Close()
+		u.conn = nil
+		return nil, fmt.Errorf("writing to DoT %s: %w", u.dialAddr, err)
+	}
+	reply, err := u.conn.ReadMsg()
+	if err != nil {
+		u.conn.Close()
+		u.conn = nil
+		return nil, fmt.Errorf("reading from DoT %s: %w", u.dialAddr, err)
+	}
+
+	return reply, nil
+}
+
+func (u *tlsUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.Close()
+	u.conn = nil
+	return err
+}
+
+// httpsUpstream is a DNS-over-HTTPS upstream using RFC 8484 wire format
+// over a reused http.Client/transport.
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSUpstream(addr string, bootstrap Bootstrap) (*httpsUpstream, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parsing DoH URL %s: %w", addr, err)
+	}
+
+	host := u.Hostname()
+	resolved, err := bootstrap.Resolve(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			port := u.Port()
+			if port == "" {
+				port = "443"
+			}
+			return tls.Dial(network, net.JoinHostPort(resolved, port), &tls.Config{ServerName: host})
+		},
+	}
+
+	return &httpsUpstream{
+		url:    addr,
+		client: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing DoH query: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, strings.NewReader(string(packed)))
+	if err != nil {
+		return nil, fmt.Errorf("building DoH request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH request to %s: %w", u.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH %s returned status %d", u.url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading DoH response: %w", err)
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unpacking DoH response: %w", err)
+	}
+
+	return reply, nil
+}
+
+func (u *httpsUpstream) Close() error {
+	u.client.CloseIdleConnections()
+	return nil
+}
+
+// quicUpstream is a DNS-over-QUIC (RFC 9250) upstream that keeps a single
+// QUIC connection open and opens a new bidirectional stream per query.
+type quicUpstream struct {
+	dialAddr   string
+	serverName string
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+func newQUICUpstream(addr string, bootstrap Bootstrap) (*quicUpstream, error) {
+	host, port, serverName, err := splitUpstreamURL(addr, "853")
+	if err != nil {
+		return nil, err
+	}
+
+	resolved, err := bootstrap.Resolve(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	return &quicUpstream{
+		serverName: serverName,
+		dialAddr:   net.JoinHostPort(resolved, port),
+	}, nil
+}
+
+func (u *quicUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	u.mu.Lock()
+	conn := u.conn
+	u.mu.Unlock()
+
+	if conn == nil {
+		var err error
+		conn, err = quic.DialAddr(ctx, u.dialAddr,
+			&tls.Config{ServerName: u.serverName, NextProtos: []string{"doq"}}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("dialing DoQ %s: %w", u.dialAddr, err)
+		}
+		u.mu.Lock()
+		u.conn = conn
+		u.mu.Unlock()
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		// Unless the caller gave up, the connection is dead: drop it so
+		// the next Exchange re-dials.
+		if ctx.Err() == nil {
+			u.mu.Lock()
+			if u.conn == conn {
+				u.conn = nil
+			}
+			u.mu.Unlock()
+			_ = conn.CloseWithError(0, "")
+		}
+		return nil, fmt.Errorf("opening DoQ stream to %s: %w", u.dialAddr, err)
+	}
+	defer stream.Close()
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing DoQ query: %w", err)
+	}
+	if _, err := stream.Write(packed); err != nil {
+		return nil, fmt.Errorf("writing DoQ query to %s: %w", u.dialAddr, err)
+	}
+	_ = stream.Close()
+
+	body, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, fmt.Errorf("reading DoQ response from %s: %w", u.dialAddr, err)
+	}
+
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, fmt.Errorf("unpacking DoQ response: %w", err)
+	}
+
+	return reply, nil
+}
+
+func (u *quicUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.CloseWithError(0, "")
+	u.conn = nil
+	return err
+}
+
+// splitUpstreamURL parses a "scheme://host[:port]" upstream address,
+// returning the host to bootstrap-resolve, the port to dial (defaultPort if
+// none was given), and the server name to present for TLS verification.
+func splitUpstreamURL(addr, defaultPort string) (host, port, serverName string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", "", fmt.Errorf("parsing upstream URL %s: %w", addr, err)
+	}
+
+	host = u.Hostname()
+	if host == "" {
+		return "", "", "", fmt.Errorf("upstream URL %s has no host", addr)
+	}
+	port = u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+
+	return host, port, host, nil
+}